@@ -0,0 +1,248 @@
+// Copyright (c) 2018 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io"
+)
+
+// Frame types of the binary protocol. The "in" types are read, the "out" types are written by the protocol.
+const (
+	frameVersion    uint8 = 0x00 // out: version string
+	frameReset      uint8 = 0x01 // in, out
+	framePacket     uint8 = 0x02 // in, out: packet data
+	frameError      uint8 = 0x03 // out
+	frameConnect    uint8 = 0x04 // out: UDID
+	frameDisconnect uint8 = 0x05 // out
+	frameReregister uint8 = 0x06 // out: UDID
+	frameOverflow   uint8 = 0x07 // out: number of dropped events (uint32)
+	frameList       uint8 = 0x08 // in, out: device records
+	frameInfo       uint8 = 0x09 // in, out: device record
+	frameNoDevice   uint8 = 0x0A // out
+	frameClaim      uint8 = 0x0B // in, out: the address has been claimed
+	frameRelease    uint8 = 0x0C // in, out: the address has been released
+	frameBusy       uint8 = 0x0D // out: the address is claimed by another client
+
+	frameCrc    uint8 = 0x80 // the frame is followed by a CRC-8 trailer
+	frameHeader       = 4    // size of the frame header
+	deviceSize        = 27   // size of a device record
+)
+
+// BinaryProtocol is a bus protocol that reads and writes length-prefixed binary frames. Every frame consists of a
+// type byte, a slave address, a big-endian 16-bit payload length and the payload. If the highest bit of the type byte
+// is set, the frame is followed by a CRC-8 trailer (see zbus.CRC8) covering the header and the payload.
+//
+// Device records hold the slave address, its UDID, priority (a signed byte), flags (bit 0 set for active slaves) and
+// the registration and last seen times as big-endian 64-bit Unix times in seconds.
+type BinaryProtocol struct {
+	r   *bufio.Reader
+	w   io.Writer
+	crc bool // protect written frames by CRC
+	max int  // maximum length of a packet
+}
+
+// NewBinaryProtocol creates a new BinaryProtocol for the specified reader and writer. The crc flag determines whether
+// the written frames are protected by CRC, frames read from r may be protected independently.
+func NewBinaryProtocol(r io.Reader, w io.Writer, crc bool) *BinaryProtocol {
+	return &BinaryProtocol{
+		r:   bufio.NewReader(r),
+		w:   w,
+		crc: crc,
+		max: zbus.MaxPacketSize,
+	}
+}
+
+// WriteVersion outputs the version frame.
+func (p *BinaryProtocol) WriteVersion(ver string) {
+	p.write(frameVersion, 0, []byte(ver))
+}
+
+// WriteError outputs the error frame.
+func (p *BinaryProtocol) WriteError(addr uint8, _ error) {
+	p.write(frameError, addr, nil)
+}
+
+// WriteReset outputs the reset frame.
+func (p *BinaryProtocol) WriteReset() {
+	p.write(frameReset, 0, nil)
+}
+
+// WritePacket outputs the packet frame.
+func (p *BinaryProtocol) WritePacket(pkt zbus.Packet) {
+	p.write(framePacket, pkt.Addr, pkt.Data)
+}
+
+// WriteConnect outputs the connect frame.
+func (p *BinaryProtocol) WriteConnect(addr uint8, dev *zbus.Device) {
+	p.writeSlave(frameConnect, addr, dev)
+}
+
+// WriteDisconnect outputs the disconnect frame.
+func (p *BinaryProtocol) WriteDisconnect(addr uint8) {
+	p.write(frameDisconnect, addr, nil)
+}
+
+// WriteReregister outputs the re-register frame.
+func (p *BinaryProtocol) WriteReregister(addr uint8, dev *zbus.Device) {
+	p.writeSlave(frameReregister, addr, dev)
+}
+
+// WriteOverflow outputs the overflow frame.
+func (p *BinaryProtocol) WriteOverflow(n int) {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], uint32(n))
+	p.write(frameOverflow, 0, data[:])
+}
+
+// WriteList outputs the list frame holding records of all devices.
+func (p *BinaryProtocol) WriteList(devs []zbus.DeviceInfo) {
+	data := make([]byte, 0, len(devs)*deviceSize)
+	for i := range devs {
+		data = appendDevice(data, &devs[i])
+	}
+
+	p.write(frameList, 0, data)
+}
+
+// WriteInfo outputs the info frame, or the no device frame if there is no such device.
+func (p *BinaryProtocol) WriteInfo(addr uint8, dev *zbus.DeviceInfo) {
+	if dev == nil {
+		p.write(frameNoDevice, addr, nil)
+		return
+	}
+
+	p.write(frameInfo, addr, appendDevice(nil, dev))
+}
+
+// WriteClaim outputs the claim frame.
+func (p *BinaryProtocol) WriteClaim(addr uint8) {
+	p.write(frameClaim, addr, nil)
+}
+
+// WriteRelease outputs the release frame.
+func (p *BinaryProtocol) WriteRelease(addr uint8) {
+	p.write(frameRelease, addr, nil)
+}
+
+// WriteBusy outputs the busy frame reporting an address claimed by another client.
+func (p *BinaryProtocol) WriteBusy(addr uint8) {
+	p.write(frameBusy, addr, nil)
+}
+
+// Read reads the next command from the protocol input.
+func (p *BinaryProtocol) Read() (Command, error) {
+	var header [frameHeader]byte
+	if _, err := io.ReadFull(p.r, header[:]); err == io.EOF {
+		return Command{}, err
+	} else if err != nil {
+		return Command{}, ErrProto
+	}
+
+	typ, addr := header[0], header[1]
+	n := int(binary.BigEndian.Uint16(header[2:]))
+	if n > p.max {
+		return Command{}, ErrProto
+	}
+
+	data := make([]byte, n, n+1)
+	if typ&frameCrc != 0 {
+		data = data[:n+1]
+	}
+
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return Command{}, ErrProto
+	}
+
+	if typ&frameCrc != 0 {
+		if zbus.CRC8(append(header[:], data[:n]...)) != data[n] {
+			// the whole frame has been read, the input continues with the next one
+			return Command{}, ErrCrc
+		}
+		data = data[:n]
+	}
+
+	switch typ &^ frameCrc {
+	case frameReset:
+		return Command{Type: CmdReset}, nil
+
+	case framePacket:
+		if n < 1 {
+			return Command{}, ErrProto
+		}
+
+		return Command{Type: CmdPacket, Pkt: zbus.Packet{Addr: addr, Data: data}}, nil
+
+	case frameList:
+		return Command{Type: CmdList}, nil
+
+	case frameInfo:
+		return Command{Type: CmdInfo, Addr: addr}, nil
+
+	case frameClaim:
+		return Command{Type: CmdClaim, Addr: addr}, nil
+
+	case frameRelease:
+		return Command{Type: CmdRelease, Addr: addr}, nil
+
+	default:
+		return Command{}, ErrProto
+	}
+}
+
+func (p *BinaryProtocol) writeSlave(typ uint8, addr uint8, dev *zbus.Device) {
+	var data []byte
+	if dev != nil {
+		data = dev.Id[:]
+	}
+
+	p.write(typ, addr, data)
+}
+
+// writes the frame at once
+func (p *BinaryProtocol) write(typ uint8, addr uint8, data []byte) {
+	frame := make([]byte, frameHeader, frameHeader+len(data)+1)
+	frame[0] = typ
+	frame[1] = addr
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+
+	if p.crc {
+		frame[0] |= frameCrc
+	}
+
+	frame = append(frame, data...)
+	if p.crc {
+		frame = append(frame, zbus.CRC8(frame))
+	}
+
+	_, _ = p.w.Write(frame)
+}
+
+// appends the device record to data
+func appendDevice(data []byte, dev *zbus.DeviceInfo) []byte {
+	var rec [deviceSize]byte
+	rec[0] = dev.Addr
+	copy(rec[1:9], dev.Dev.Id[:])
+	rec[9] = uint8(int8(dev.Dev.Priority))
+	if dev.Active {
+		rec[10] = 0x01
+	}
+	binary.BigEndian.PutUint64(rec[11:19], uint64(dev.Registered.Unix()))
+	binary.BigEndian.PutUint64(rec[19:27], uint64(dev.LastSeen.Unix()))
+
+	return append(data, rec[:]...)
+}
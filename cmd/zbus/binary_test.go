@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// TestBinaryRead tests parsing of binary frames.
+func TestBinaryRead(t *testing.T) {
+	// appends the CRC-8 trailer to the frame
+	crc := func(frame ...byte) []byte {
+		return append(frame, zbus.CRC8(frame))
+	}
+
+	long := append([]byte{framePacket, 0x10, 0x00, zbus.MaxPacketSize + 1}, make([]byte, zbus.MaxPacketSize+1)...)
+
+	for _, x := range []struct {
+		name  string
+		frame []byte
+		cmd   Command
+		err   error
+	}{
+		{"reset", []byte{frameReset, 0, 0, 0}, Command{Type: CmdReset}, nil},
+		{"packet", []byte{framePacket, 0x10, 0, 2, 0x42, 0x43},
+			Command{Type: CmdPacket, Pkt: zbus.Packet{Addr: 0x10, Data: []byte{0x42, 0x43}}}, nil},
+		{"list", []byte{frameList, 0, 0, 0}, Command{Type: CmdList}, nil},
+		{"info", []byte{frameInfo, 0x10, 0, 0}, Command{Type: CmdInfo, Addr: 0x10}, nil},
+		{"claim", []byte{frameClaim, 0x10, 0, 0}, Command{Type: CmdClaim, Addr: 0x10}, nil},
+		{"release", []byte{frameRelease, 0x10, 0, 0}, Command{Type: CmdRelease, Addr: 0x10}, nil},
+		{"crc", crc(framePacket|frameCrc, 0x10, 0, 1, 0x42),
+			Command{Type: CmdPacket, Pkt: zbus.Packet{Addr: 0x10, Data: []byte{0x42}}}, nil},
+		{"crc reset", crc(frameReset|frameCrc, 0, 0, 0), Command{Type: CmdReset}, nil},
+		{"bad crc", []byte{framePacket | frameCrc, 0x10, 0, 1, 0x42, 0x00}, Command{}, ErrCrc},
+		{"missing crc", []byte{framePacket | frameCrc, 0x10, 0, 1, 0x42}, Command{}, ErrProto},
+		{"too long", long, Command{}, ErrProto},
+		{"empty packet", []byte{framePacket, 0x10, 0, 0}, Command{}, ErrProto},
+		{"truncated header", []byte{framePacket, 0x10}, Command{}, ErrProto},
+		{"truncated data", []byte{framePacket, 0x10, 0, 2, 0x42}, Command{}, ErrProto},
+		{"unknown type", []byte{frameVersion, 0, 0, 0}, Command{}, ErrProto},
+		{"end", nil, Command{}, io.EOF},
+	} {
+		p := NewBinaryProtocol(bytes.NewReader(x.frame), nil, false)
+
+		cmd, err := p.Read()
+		if err != x.err || !reflect.DeepEqual(cmd, x.cmd) {
+			t.Errorf("Invalid result of %v frame, %+v, %v expected, got %+v, %v", x.name, x.cmd, x.err, cmd, err)
+		}
+	}
+}
+
+// TestBinaryPacket tests that written packet frames can be read back, the length limit is applied to both ends.
+func TestBinaryPacket(t *testing.T) {
+	for _, crc := range []bool{false, true} {
+		var buf bytes.Buffer
+		pkt := zbus.Packet{Addr: 0x10, Data: bytes.Repeat([]byte{0x42}, 200)}
+
+		NewBinaryProtocol(nil, &buf, crc).WritePacket(pkt)
+
+		p := NewBinaryProtocol(bytes.NewReader(buf.Bytes()), nil, false)
+		if _, err := p.Read(); err != ErrProto {
+			t.Errorf("Too long packet read (crc %v): %v", crc, err)
+		}
+
+		p = NewBinaryProtocol(bytes.NewReader(buf.Bytes()), nil, false)
+		p.max = len(pkt.Data)
+
+		if cmd, err := p.Read(); err != nil || cmd.Type != CmdPacket || !reflect.DeepEqual(cmd.Pkt, pkt) {
+			t.Errorf("Invalid packet read (crc %v): %+v, %v", crc, cmd, err)
+		}
+	}
+}
+
+// TestBinaryResync tests that a frame with a CRC mismatch is skipped and the following frames are read.
+func TestBinaryResync(t *testing.T) {
+	bad := []byte{framePacket | frameCrc, 0x10, 0, 2, 0x42, 0x43, 0x00}
+	reset := []byte{frameReset, 0, 0, 0}
+
+	p := NewBinaryProtocol(bytes.NewReader(append(bad, reset...)), nil, false)
+
+	if _, err := p.Read(); err != ErrCrc {
+		t.Fatalf("ErrCrc expected, got %v", err)
+	}
+
+	if cmd, err := p.Read(); err != nil || cmd.Type != CmdReset {
+		t.Errorf("Next frame not read: %+v, %v", cmd, err)
+	}
+
+	if _, err := p.Read(); err != io.EOF {
+		t.Errorf("End of input expected, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2018 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"sync"
+	"time"
+)
+
+// claims tracks slave addresses claimed by clients. Packets from a claimed address are delivered only to the client
+// that owns it and packets sent to the address by other clients are rejected. Clients are identified by their
+// protocols. A claim holds the slave registered at the address when it was claimed and ends as soon as the bus does not
+// report that registration anymore, i.e. when the slave disconnects, registers again or the bus is reset. The bus is
+// asked instead of relying on events, which a slow client may lose.
+type claims struct {
+	devs devices
+
+	mu     sync.Mutex
+	owners map[uint8]claim
+}
+
+// devices looks up slaves, implemented by zbus.Bus
+type devices interface {
+	Device(addr zbus.Address) (zbus.DeviceInfo, bool)
+}
+
+// a claimed registration of a slave
+type claim struct {
+	owner      Protocol
+	id         zbus.Udid
+	registered time.Time
+}
+
+func newClaims(devs devices) *claims {
+	return &claims{devs: devs, owners: make(map[uint8]claim)}
+}
+
+// Claims the address for the client. Reports whether the client owns the address, an address without a slave cannot
+// be claimed.
+func (c *claims) claim(addr uint8, client Protocol) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if owner, ok := c.owner(addr); ok && owner != client {
+		return false
+	}
+
+	dev, ok := c.devs.Device(addr)
+	if !ok {
+		return false
+	}
+
+	c.owners[addr] = claim{owner: client, id: dev.Dev.Id, registered: dev.Registered}
+	return true
+}
+
+// Releases the address claimed by the client. Reports false if another client owns the address.
+func (c *claims) release(addr uint8, client Protocol) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if owner, ok := c.owner(addr); ok && owner != client {
+		return false
+	}
+
+	delete(c.owners, addr)
+	return true
+}
+
+// Releases all addresses claimed by the client.
+func (c *claims) releaseAll(client Protocol) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, cl := range c.owners {
+		if cl.owner == client {
+			delete(c.owners, addr)
+		}
+	}
+}
+
+// Reports whether the client may communicate with the address, i.e. the address is not claimed by another client.
+func (c *claims) allowed(addr uint8, client Protocol) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owner, ok := c.owner(addr)
+	return !ok || owner == client
+}
+
+// Returns the owner of the address, the claim ends if the slave is not registered anymore. The caller holds the mutex.
+func (c *claims) owner(addr uint8) (Protocol, bool) {
+	cl, ok := c.owners[addr]
+	if !ok {
+		return nil, false
+	}
+
+	if dev, ok := c.devs.Device(addr); !ok || dev.Dev.Id != cl.id || !dev.Registered.Equal(cl.registered) {
+		delete(c.owners, addr)
+		return nil, false
+	}
+
+	return cl.owner, true
+}
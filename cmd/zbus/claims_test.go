@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDevices is a table of registered slaves
+type fakeDevices map[zbus.Address]zbus.DeviceInfo
+
+func (d fakeDevices) Device(addr zbus.Address) (zbus.DeviceInfo, bool) {
+	dev, ok := d[addr]
+	return dev, ok
+}
+
+// TestClaimsEnd tests that claims end when the slave leaves the address, even if the owner misses the events.
+func TestClaimsEnd(t *testing.T) {
+	devs := fakeDevices{}
+	c := newClaims(devs)
+	owner := NewTextProtocol(strings.NewReader(""), ioutil.Discard)
+	other := NewTextProtocol(strings.NewReader(""), ioutil.Discard)
+
+	var n int64
+	register := func(addr zbus.Address, id byte) {
+		n++
+		devs[addr] = zbus.DeviceInfo{Addr: addr, Dev: zbus.Device{Id: zbus.Udid{id}}, Registered: time.Unix(n, 0)}
+	}
+
+	if c.claim(0x10, owner) {
+		t.Fatalf("Address without a slave claimed")
+	}
+
+	register(0x10, 1)
+	register(0x11, 2)
+	if !c.claim(0x10, owner) || !c.claim(0x11, owner) || c.claim(0x10, other) {
+		t.Fatalf("Invalid claims")
+	}
+
+	if c.allowed(0x10, other) || !c.allowed(0x10, owner) || !c.allowed(0x12, other) {
+		t.Fatalf("Invalid permissions")
+	}
+
+	// the owner misses the disconnect of the slave, another slave gets its address
+	delete(devs, 0x10)
+	register(0x10, 3)
+	if !c.allowed(0x10, other) {
+		t.Errorf("Claim of a disconnected slave not ended")
+	}
+
+	// the slave registers again, e.g. after a reset of the bus
+	register(0x11, 2)
+	if !c.claim(0x11, other) {
+		t.Errorf("Claim of a re-registered slave not ended")
+	}
+
+	if c.release(0x11, owner) || !c.release(0x11, other) {
+		t.Errorf("Invalid release")
+	}
+}
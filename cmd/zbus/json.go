@@ -0,0 +1,259 @@
+// Copyright (c) 2018 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	enchex "encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io"
+	"time"
+)
+
+// JSONProtocol is a bus protocol that reads and writes newline-delimited JSON objects. Every object has the "type"
+// key, objects written by the protocol have the "time" key as well. Addresses are numbers, packet data and UDIDs are
+// hex strings.
+type JSONProtocol struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	max int // maximum length of a packet
+}
+
+// command read from the input
+type jsonCommand struct {
+	Type string `json:"type"`
+	Addr *uint8 `json:"addr"`
+	Data string `json:"data"`
+}
+
+type jsonHeader struct {
+	Type string `json:"type"`
+	Time string `json:"time"`
+}
+
+type jsonVersion struct {
+	jsonHeader
+	Version string `json:"version"`
+}
+
+type jsonPacket struct {
+	jsonHeader
+	Addr uint8  `json:"addr"`
+	Data string `json:"data"`
+}
+
+type jsonError struct {
+	jsonHeader
+	Addr    uint8  `json:"addr"`
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+type jsonSlave struct {
+	jsonHeader
+	Addr uint8  `json:"addr"`
+	Udid string `json:"udid,omitempty"`
+}
+
+type jsonOverflow struct {
+	jsonHeader
+	Dropped int `json:"dropped"`
+}
+
+type jsonDevice struct {
+	Addr       uint8  `json:"addr"`
+	Udid       string `json:"udid"`
+	Priority   string `json:"priority"`
+	Registered string `json:"registered"`
+	LastSeen   string `json:"lastSeen"`
+	Active     bool   `json:"active"`
+}
+
+type jsonList struct {
+	jsonHeader
+	Devices []jsonDevice `json:"devices"`
+}
+
+type jsonInfo struct {
+	jsonHeader
+	jsonDevice
+}
+
+// NewJSONProtocol creates a new JSONProtocol for the specified reader and writer.
+func NewJSONProtocol(r io.Reader, w io.Writer) *JSONProtocol {
+	return &JSONProtocol{
+		dec: json.NewDecoder(r),
+		enc: json.NewEncoder(w),
+		max: zbus.MaxPacketSize,
+	}
+}
+
+// WriteVersion outputs the "version" object.
+func (p *JSONProtocol) WriteVersion(ver string) {
+	p.write(jsonVersion{p.header("version"), ver})
+}
+
+// WriteError outputs the "error" object, the "error" key holds the error type, e.g. "ack".
+func (p *JSONProtocol) WriteError(addr uint8, err error) {
+	msg := jsonError{jsonHeader: p.header("error"), Addr: addr, Error: "bus"}
+
+	var e *zbus.Error
+	if errors.As(err, &e) {
+		msg.Error = e.Type.String()
+	}
+
+	if err != nil {
+		msg.Message = err.Error()
+	}
+
+	p.write(msg)
+}
+
+// WriteReset outputs the "reset" object.
+func (p *JSONProtocol) WriteReset() {
+	p.write(p.header("reset"))
+}
+
+// WritePacket outputs the "packet" object.
+func (p *JSONProtocol) WritePacket(pkt zbus.Packet) {
+	p.write(jsonPacket{p.header("packet"), pkt.Addr, enchex.EncodeToString(pkt.Data)})
+}
+
+// WriteConnect outputs the "connect" object.
+func (p *JSONProtocol) WriteConnect(addr uint8, dev *zbus.Device) {
+	p.writeSlave("connect", addr, dev)
+}
+
+// WriteDisconnect outputs the "disconnect" object.
+func (p *JSONProtocol) WriteDisconnect(addr uint8) {
+	p.writeSlave("disconnect", addr, nil)
+}
+
+// WriteReregister outputs the "reregister" object.
+func (p *JSONProtocol) WriteReregister(addr uint8, dev *zbus.Device) {
+	p.writeSlave("reregister", addr, dev)
+}
+
+// WriteOverflow outputs the "overflow" object.
+func (p *JSONProtocol) WriteOverflow(n int) {
+	p.write(jsonOverflow{p.header("overflow"), n})
+}
+
+// WriteList outputs the "list" object holding all devices.
+func (p *JSONProtocol) WriteList(devs []zbus.DeviceInfo) {
+	list := jsonList{p.header("list"), make([]jsonDevice, len(devs))}
+	for i := range devs {
+		list.Devices[i] = device(&devs[i])
+	}
+
+	p.write(list)
+}
+
+// WriteInfo outputs the "device" object, or the "nodev" object if there is no such device.
+func (p *JSONProtocol) WriteInfo(addr uint8, dev *zbus.DeviceInfo) {
+	if dev == nil {
+		p.writeSlave("nodev", addr, nil)
+		return
+	}
+
+	p.write(jsonInfo{p.header("device"), device(dev)})
+}
+
+// WriteClaim outputs the "claimed" object.
+func (p *JSONProtocol) WriteClaim(addr uint8) {
+	p.writeSlave("claimed", addr, nil)
+}
+
+// WriteRelease outputs the "released" object.
+func (p *JSONProtocol) WriteRelease(addr uint8) {
+	p.writeSlave("released", addr, nil)
+}
+
+// WriteBusy outputs the "busy" object reporting an address claimed by another client.
+func (p *JSONProtocol) WriteBusy(addr uint8) {
+	p.writeSlave("busy", addr, nil)
+}
+
+// Read reads the next command from the protocol input.
+func (p *JSONProtocol) Read() (Command, error) {
+	var cmd jsonCommand
+	if err := p.dec.Decode(&cmd); err == io.EOF {
+		return Command{}, err
+	} else if err != nil {
+		return Command{}, ErrProto
+	}
+
+	switch cmd.Type {
+	case "reset":
+		return Command{Type: CmdReset}, nil
+
+	case "packet":
+		data, err := enchex.DecodeString(cmd.Data)
+		if err != nil || cmd.Addr == nil || len(data) < 1 || len(data) > p.max {
+			return Command{}, ErrProto
+		}
+
+		return Command{Type: CmdPacket, Pkt: zbus.Packet{Addr: *cmd.Addr, Data: data}}, nil
+
+	case "list":
+		return Command{Type: CmdList}, nil
+
+	case "info", "claim", "release":
+		if cmd.Addr == nil {
+			return Command{}, ErrProto
+		}
+
+		typ := CmdInfo
+		if cmd.Type == "claim" {
+			typ = CmdClaim
+		} else if cmd.Type == "release" {
+			typ = CmdRelease
+		}
+
+		return Command{Type: typ, Addr: *cmd.Addr}, nil
+
+	default:
+		return Command{}, ErrProto
+	}
+}
+
+func (p *JSONProtocol) header(typ string) jsonHeader {
+	return jsonHeader{typ, time.Now().UTC().Format(time.RFC3339Nano)}
+}
+
+func (p *JSONProtocol) writeSlave(typ string, addr uint8, dev *zbus.Device) {
+	msg := jsonSlave{jsonHeader: p.header(typ), Addr: addr}
+	if dev != nil {
+		msg.Udid = enchex.EncodeToString(dev.Id[:])
+	}
+
+	p.write(msg)
+}
+
+func (p *JSONProtocol) write(v interface{}) {
+	_ = p.enc.Encode(v)
+}
+
+func device(dev *zbus.DeviceInfo) jsonDevice {
+	return jsonDevice{
+		Addr:       dev.Addr,
+		Udid:       enchex.EncodeToString(dev.Dev.Id[:]),
+		Priority:   dev.Dev.Priority.String(),
+		Registered: dev.Registered.UTC().Format(time.RFC3339),
+		LastSeen:   dev.LastSeen.UTC().Format(time.RFC3339),
+		Active:     dev.Active,
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestJSONRead tests parsing of JSON commands.
+func TestJSONRead(t *testing.T) {
+	long := strings.Repeat("42", zbus.MaxPacketSize+1)
+
+	for _, x := range []struct {
+		name  string
+		input string
+		cmd   Command
+		err   error
+	}{
+		{"reset", `{"type": "reset"}`, Command{Type: CmdReset}, nil},
+		{"packet", `{"type": "packet", "addr": 16, "data": "4243"}`,
+			Command{Type: CmdPacket, Pkt: zbus.Packet{Addr: 0x10, Data: []byte{0x42, 0x43}}}, nil},
+		{"list", `{"type": "list"}`, Command{Type: CmdList}, nil},
+		{"info", `{"type": "info", "addr": 16}`, Command{Type: CmdInfo, Addr: 0x10}, nil},
+		{"claim", `{"type": "claim", "addr": 16}`, Command{Type: CmdClaim, Addr: 0x10}, nil},
+		{"release", `{"type": "release", "addr": 16}`, Command{Type: CmdRelease, Addr: 0x10}, nil},
+		{"missing packet addr", `{"type": "packet", "data": "42"}`, Command{}, ErrProto},
+		{"missing info addr", `{"type": "info"}`, Command{}, ErrProto},
+		{"addr out of range", `{"type": "packet", "addr": 256, "data": "42"}`, Command{}, ErrProto},
+		{"negative addr", `{"type": "claim", "addr": -1}`, Command{}, ErrProto},
+		{"bad hex", `{"type": "packet", "addr": 16, "data": "4x"}`, Command{}, ErrProto},
+		{"odd hex", `{"type": "packet", "addr": 16, "data": "424"}`, Command{}, ErrProto},
+		{"empty data", `{"type": "packet", "addr": 16, "data": ""}`, Command{}, ErrProto},
+		{"oversized data", `{"type": "packet", "addr": 16, "data": "` + long + `"}`, Command{}, ErrProto},
+		{"unknown type", `{"type": "quit"}`, Command{}, ErrProto},
+		{"missing type", `{"addr": 16}`, Command{}, ErrProto},
+		{"invalid json", `{"type": `, Command{}, ErrProto},
+		{"end", ``, Command{}, io.EOF},
+	} {
+		p := NewJSONProtocol(strings.NewReader(x.input), nil)
+
+		cmd, err := p.Read()
+		if err != x.err || !reflect.DeepEqual(cmd, x.cmd) {
+			t.Errorf("Invalid result of %v command, %+v, %v expected, got %+v, %v", x.name, x.cmd, x.err, cmd, err)
+		}
+	}
+}
@@ -16,13 +16,20 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/frag"
+	"github.com/omSquare/zen-bus/pkg/zbus/reliable"
 	"io"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 const (
@@ -35,65 +42,200 @@ type input struct {
 	err error
 }
 
+var (
+	crc       = flag.Bool("crc", false, "")
+	discovery = flag.Duration("discovery", time.Second, "")
+	silence   = flag.Duration("silence", 5*time.Second, "")
+	slaves    = flag.Int("slaves", zbus.MaxSlaves, "")
+	logLevel  = flag.String("log", "info", "")
+	logJSON   = flag.Bool("log-json", false, "")
+	leases    = flag.String("leases", "", "")
+	policy    = flag.String("policy", "", "")
+	rereg     = flag.String("reregister", "reconnect", "")
+	fragment  = flag.Bool("frag", false, "")
+	reliably  = flag.Bool("reliable", false, "")
+	events    = flag.Int("events", zbus.EventCapacity, "")
+	overflow  = flag.String("overflow", "block", "")
+	grace     = flag.Duration("shutdown", 5*time.Second, "")
+	format    = flag.String("format", "text", "")
+	metrics   = flag.String("metrics", "", "")
+)
+
 func main() {
-	if len(os.Args) == 1 {
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.Usage = printHelp
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		os.Exit(exitUsage)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
 		printHelp()
 		os.Exit(exitUsage)
 	}
 
-	var (
-		b   zbus.Bus
-		err error
-	)
+	if !validFormat(*format) {
+		printErr("error: invalid format '%s'\n", *format)
+		os.Exit(exitUsage)
+	}
+
+	var lns []listener
+	if args[0] == "serve" {
+		lns, args = parseServe(args[1:])
+	}
+
+	level, err := zbus.ParseLevel(*logLevel)
+	if err != nil {
+		printErr("error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	logger := zbus.NewLogger(nil, level)
+	if *logJSON {
+		logger = zbus.NewJSONLogger(os.Stderr, level)
+	}
+
+	// the options of events apply to the bus wrappers as well
+	evOpts := []zbus.Option{
+		zbus.WithEventCapacity(*events),
+		zbus.WithLogger(logger),
+	}
+
+	opts := []zbus.Option{
+		zbus.WithDiscoveryInterval(*discovery),
+		zbus.WithSilenceTimeout(*silence),
+		zbus.WithMaxSlaves(*slaves),
+	}
+
+	if *crc {
+		opts = append(opts, zbus.WithCRC())
+	}
+
+	if *leases != "" {
+		opts = append(opts, zbus.WithLeaseStore(zbus.NewFileLeaseStore(*leases)))
+	}
+
+	switch *overflow {
+	case "block":
+		evOpts = append(evOpts, zbus.WithOverflow(zbus.Block))
+
+	case "drop-oldest":
+		evOpts = append(evOpts, zbus.WithOverflow(zbus.DropOldest))
+
+	case "drop-newest":
+		evOpts = append(evOpts, zbus.WithOverflow(zbus.DropNewest))
+
+	case "coalesce":
+		evOpts = append(evOpts, zbus.WithOverflow(zbus.Coalesce))
+
+	default:
+		printErr("error: invalid overflow policy '%s'\n", *overflow)
+		os.Exit(exitUsage)
+	}
+
+	opts = append(opts, evOpts...)
 
-	switch os.Args[1] {
+	switch *rereg {
+	case "reconnect":
+		opts = append(opts, zbus.WithReregistration(zbus.Reconnect))
+
+	case "keep":
+		opts = append(opts, zbus.WithReregistration(zbus.KeepAddress))
+
+	default:
+		printErr("error: invalid re-registration mode '%s'\n", *rereg)
+		os.Exit(exitUsage)
+	}
+
+	if *policy != "" {
+		p, err := loadPolicy(*policy)
+		if err != nil {
+			printErr("error: %v\n", err)
+			os.Exit(exitUsage)
+		}
+
+		opts = append(opts, zbus.WithPolicy(p))
+	}
+
+	var mln net.Listener
+	if *metrics != "" {
+		if mln, err = listenMetrics(*metrics); err != nil {
+			printErr("error: metrics: %v\n", err)
+			os.Exit(exitIOErr)
+		}
+	}
+
+	var b zbus.Bus
+
+	switch args[0] {
 	case "i2c":
-		b, err = createI2CBus()
+		b, err = createI2CBus(args[1:], opts)
 
 	case "sim":
-		b, err = createSimBus()
+		b, err = createSimBus(args[1:], opts)
 
 	default:
-		printErr("error: invalid bus type '%s'", os.Args[1])
+		printErr("error: invalid bus type '%s'\n", args[0])
 		os.Exit(exitUsage)
 	}
 
 	if err != nil {
+		for _, ln := range lns {
+			_ = ln.Close()
+		}
+
 		printErr("error: %v\n", err)
 		os.Exit(exitIOErr)
 	}
 
+	// the statistics are taken from the bus before it is wrapped
+	if sb, ok := b.(zbus.StatsProvider); ok && mln != nil {
+		go serveMetrics(mln, sb)
+	}
+
+	if *fragment {
+		b = frag.New(b, frag.WithEvents(evOpts...))
+	}
+
+	if *reliably {
+		b = reliable.New(b, reliable.WithEvents(evOpts...))
+	}
+
+	if lns != nil {
+		os.Exit(serve(b, lns, logger))
+	}
+
 	os.Exit(loop(b))
 }
 
-func createI2CBus() (zbus.Bus, error) {
-	if len(os.Args) != 4 {
-		printErr("error: invalid 'i2c' bus arguments")
+func createI2CBus(args []string, opts []zbus.Option) (zbus.Bus, error) {
+	if len(args) != 2 {
+		printErr("error: invalid 'i2c' bus arguments\n")
 		os.Exit(exitUsage)
 	}
 
-	dev, err := strconv.Atoi(os.Args[2])
+	dev, err := strconv.Atoi(args[0])
 	if err != nil {
 		printErr("error: invalid I2C device number\n")
 		os.Exit(exitUsage)
 	}
 
-	pin, err := strconv.Atoi(os.Args[3])
+	pin, err := zbus.ParseAlertPin(args[1])
 	if err != nil {
-		printErr("error: invalid GPIO pin number\n")
+		printErr("error: %v\n", err)
 		os.Exit(exitUsage)
 	}
 
-	return zbus.NewI2CBus(dev, pin)
+	return zbus.NewI2CBus(dev, pin, opts...)
 }
 
-func createSimBus() (zbus.Bus, error) {
-	if len(os.Args) != 3 {
-		printErr("error: invalid 'i2c' bus arguments")
+func createSimBus(args []string, opts []zbus.Option) (zbus.Bus, error) {
+	if len(args) != 1 {
+		printErr("error: invalid 'sim' bus arguments\n")
 		os.Exit(exitUsage)
 	}
 
-	return zbus.NewSimBus(os.Args[2])
+	return zbus.NewSimBus(args[0], opts...)
 }
 
 func printErr(format string, args ...interface{}) {
@@ -111,125 +253,344 @@ this bus simulation when running on native POSIX platform.
 
 To create an I²C Zbus master, run
 
-  zbus i2c <i2c_num> <gpio_num>
+  zbus [options] i2c <i2c_num> <gpio>
 
-where <i2c_num> is the number of the I²C device (/dev/i2c-X) and <gpio_num>
-is the number of the GPIO pin (/sys/class/gpio/gpioX). 
+where <i2c_num> is the number of the I²C device (/dev/i2c-X) and <gpio> is
+the alert pin, either a line of a GPIO character device in "gpiochipN:L"
+format (line L of /dev/gpiochipN) or the number of a legacy sysfs GPIO pin
+(/sys/class/gpio/gpioX). Some examples: "gpiochip0:17", "17"
 
 To create a simulated Zbus master, run
 
-  zbus sim <address>
+  zbus [options] sim <address>
 
 where <address> is the address in "host:port" format the TCP server will
 bind to. The server will bind to all available interfaces if the "host" part
 is empty. Some examples: ":7802", "[::1]:7802"
+
+To share the bus by several clients instead of using stdin and stdout, run
+
+  zbus [options] serve -listen <listener> [-listen <listener>...] <bus>
+
+where <bus> is one of the above bus types followed by its arguments and
+<listener> is "unix:<path>" or "tcp:<host>:<port>", optionally followed by
+",<format>" to override the -format option for its clients. Every client
+receives all bus events, a client that does not read them fast enough
+loses them. Some examples: "unix:/run/zbus.sock", "tcp:127.0.0.1:7900,json"
+
+A client can claim a slave address by "CLAIM <addr>" to communicate with the
+slave exclusively until "RELEASE <addr>", until it disconnects or until the
+slave leaves the address. Packets from a claimed address are delivered only
+to the owner, while other clients get "BUSY <addr>" when sending to it or
+claiming it. Claiming an address without a slave gets "BUSY <addr>" too.
+
+Options:
+
+  -format <f>     format of commands on stdin and stdout: "text", "json" for
+                  newline-delimited JSON objects, e.g. {"type": "packet",
+                  "addr": 16, "data": "aabb"}, or "binary" for frames of
+                  a type byte, address, 16-bit big-endian payload length and
+                  the payload; "binary-crc" appends a CRC-8 to every frame
+                  written; a frame read with a bad CRC is skipped and
+                  reported by an error frame (default text)
+  -crc            protect packets with a CRC-8 trailer (SMBus PEC), slaves
+                  must be configured to use it as well
+  -discovery <d>  interval of discovering new slaves (default 1s)
+  -silence <d>    time after which a silent slave is pinged (default 5s)
+  -slaves <n>     maximum number of connected slaves (default 32)
+  -events <n>     capacity of the event queue (default 8)
+  -overflow <p>   what to do when events are not consumed fast enough:
+                  "block" the bus, "drop-oldest" or "drop-newest" queued
+                  events, or "coalesce" events of the same type and slave
+                  address; dropped events are reported by OVF (default block)
+  -shutdown <d>   time allowed for delivering pending packets and notifying
+                  slaves on exit (default 5s)
+  -metrics <addr> serve bus statistics in the Prometheus text format over HTTP
+                  at the /metrics path, the address is "<host>:<port>" with
+                  the host defaulting to localhost, e.g. ":9102"
+  -log <level>    minimum level of logged messages: debug, info, warn or
+                  error (default info)
+  -log-json       write log messages to stderr as JSON objects
+  -leases <file>  keep addresses assigned to slaves in the JSON file, so that
+                  a known slave gets its previous address back
+  -reregister <m> how to report a connected slave that registers again:
+                  "reconnect" reports DISC of its previous address and CONN
+                  of the new one, "keep" keeps the address and reports REREG
+                  (default reconnect)
+  -frag           split packets into fragments and reassemble them, so that
+                  packets of up to 16128 bytes can be sent and received,
+                  slaves must use the same fragment format
+  -reliable       acknowledge packets end-to-end and retransmit them until
+                  acknowledged, slaves must use the same protocol
+  -policy <file>  restrict registration of slaves and set their priorities
+                  by the JSON file, e.g. {"reserved": {"10": "<udid>"},
+                  "allow": ["<prefix>"], "deny": ["<prefix>"],
+                  "high": ["<prefix>"], "low": ["<prefix>"]} where addresses
+                  are hex numbers, UDIDs and their prefixes are hex strings
 `)
 }
 
 func loop(b zbus.Bus) int {
-	defer b.Close()
+	proto := newProtocol(*format, os.Stdin, os.Stdout)
+	c := newClaims(b)
+	err := session(proto, b, c, b.Events(), interrupted())
+
+	shutdown(b, func(ev zbus.Event) {
+		_ = processEvent(proto, c, ev)
+	})
+
+	if err != nil && err != io.EOF {
+		printErr("error: %v\n", err)
+		return exitIOErr
+	}
 
+	return 0
+}
+
+// Returns a channel that is closed when the program is interrupted.
+func interrupted() <-chan struct{} {
 	done := make(chan struct{})
 
 	go func() {
 		sig := make(chan os.Signal, 8)
-		signal.Notify(sig, os.Interrupt)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
 		<-sig
 
 		close(done)
 	}()
 
-	proto := NewTextProtocol(os.Stdin, os.Stdout)
-	input := readCommands(proto)
+	return done
+}
+
+// Passes commands read by the protocol to the bus and writes the events to the protocol until the input ends, the
+// events channel is closed, an event cannot be written or done is closed. Addresses claimed by the session are
+// released at its end.
+func session(proto Protocol, b zbus.Bus, c *claims, events <-chan zbus.Event, done <-chan struct{}) error {
+	quit := make(chan struct{})
+	defer close(quit)
+	defer c.releaseAll(proto)
+
+	input := readCommands(proto, quit)
 
 	proto.WriteVersion(zbus.Version)
 
-	var err error
+	for {
+		var err error
 
-loop:
-	for err = error(nil); err == nil; {
 		select {
 		case in, ok := <-input:
+			if in.err == ErrCrc {
+				// a corrupted frame is reported and skipped
+				proto.WriteError(0, in.err)
+				break
+			}
+
 			if in.err != nil || !ok {
-				err = in.err
-			} else {
-				err = processCommand(b, in.cmd)
+				return in.err
 			}
 
-		case ev, ok := <-b.Events():
+			err = processCommand(proto, b, c, in.cmd)
+
+		case ev, ok := <-events:
 			if !ok {
-				err = nil
-			} else {
-				err = processEvent(proto, ev)
+				// the bus terminated
+				return nil
 			}
 
+			err = processEvent(proto, c, ev)
+
 		case <-done:
-			break loop
+			return nil
+		}
+
+		if err != nil {
+			return err
 		}
 	}
+}
 
-	if err != nil && err != io.EOF {
-		printErr("error: %v\n", err)
-		return exitIOErr
+// Shuts the bus down gracefully, events are reported until the bus terminates.
+func shutdown(b zbus.Bus, report func(ev zbus.Event)) {
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+
+	res := make(chan error, 1)
+	go func() {
+		res <- b.Shutdown(ctx)
+	}()
+
+	events := b.Events()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				break
+			}
+
+			report(ev)
+
+		case err := <-res:
+			if err != nil {
+				printErr("warning: graceful shutdown failed: %v\n", err)
+				b.Close()
+			}
+			return
+		}
 	}
+}
 
-	return 0
+// Creates the protocol of the given format, the maximum length of packets depends on the bus wrappers.
+func newProtocol(format string, r io.Reader, w io.Writer) Protocol {
+	max := zbus.MaxPacketSize
+	if *fragment {
+		max = frag.MaxMessageSize
+	}
+
+	if *reliably {
+		// leave room for the message header
+		max -= zbus.MaxPacketSize - reliable.MaxMessageSize
+	}
+
+	switch format {
+	case "json":
+		p := NewJSONProtocol(r, w)
+		p.max = max
+		return p
+
+	case "binary", "binary-crc":
+		p := NewBinaryProtocol(r, w, format == "binary-crc")
+		p.max = max
+		return p
+
+	default:
+		p := NewTextProtocol(r, w)
+		p.max = max
+		return p
+	}
+}
+
+// Reports whether the protocol format is supported.
+func validFormat(format string) bool {
+	switch format {
+	case "text", "json", "binary", "binary-crc":
+		return true
+	default:
+		return false
+	}
 }
 
-func readCommands(proto Protocol) chan input {
+// Reads commands until the protocol input ends or quit is closed.
+func readCommands(proto Protocol, quit <-chan struct{}) chan input {
 	ch := make(chan input)
 	go func() {
+		defer close(ch)
+
 		for {
 			cmd, err := proto.Read()
-			if err != nil {
-				ch <- input{Command{}, err}
-				close(ch)
+
+			select {
+			case ch <- input{cmd, err}:
+				break
+
+			case <-quit:
 				return
 			}
 
-			ch <- input{cmd, nil}
+			if err != nil && err != ErrCrc {
+				return
+			}
 		}
 	}()
 
 	return ch
 }
 
-func processCommand(b zbus.Bus, cmd Command) error {
+func processCommand(p Protocol, b zbus.Bus, c *claims, cmd Command) error {
 	switch cmd.Type {
 	case CmdReset:
 		b.Reset()
 
 	case CmdPacket:
+		if !c.allowed(cmd.Pkt.Addr, p) {
+			p.WriteBusy(cmd.Pkt.Addr)
+			break
+		}
+
 		b.Send(cmd.Pkt)
+
+	case CmdClaim:
+		if c.claim(cmd.Addr, p) {
+			p.WriteClaim(cmd.Addr)
+		} else {
+			p.WriteBusy(cmd.Addr)
+		}
+
+	case CmdRelease:
+		if c.release(cmd.Addr, p) {
+			p.WriteRelease(cmd.Addr)
+		} else {
+			p.WriteBusy(cmd.Addr)
+		}
+
+	case CmdList:
+		p.WriteList(b.Devices())
+
+	case CmdInfo:
+		if dev, ok := b.Device(cmd.Addr); ok {
+			p.WriteInfo(cmd.Addr, &dev)
+		} else {
+			p.WriteInfo(cmd.Addr, nil)
+		}
 	}
 	return nil
 }
 
-func processEvent(p Protocol, ev zbus.Event) error {
+func processEvent(p Protocol, c *claims, ev zbus.Event) error {
 	switch ev.Type {
 	case zbus.ResetEvent:
 		p.WriteReset()
 
 	case zbus.PacketEvent:
-		p.WritePacket(*ev.Pkt)
+		if c.allowed(ev.Pkt.Addr, p) {
+			p.WritePacket(*ev.Pkt)
+		}
 
 	case zbus.ErrorEvent:
-		if ev.Err == zbus.SysError {
-			// TODO(mbenda): proper SysError error passing
-			return errors.New("unrecoverable bus error")
+		if err := sysError(ev); err != nil {
+			return err
 		}
-		p.WriteError(ev.Addr)
+		p.WriteError(ev.Addr, ev.Cause)
 
 	case zbus.ConnectEvent:
-		p.WriteConnect(ev.Addr)
+		p.WriteConnect(ev.Addr, ev.Dev)
 
 	case zbus.DisconnectEvent:
 		p.WriteDisconnect(ev.Addr)
 
+	case zbus.ReregisterEvent:
+		p.WriteReregister(ev.Addr, ev.Dev)
+
+	case zbus.OverflowEvent:
+		p.WriteOverflow(ev.Dropped)
+
 	default:
 		return errors.New("unsupported bus event")
 	}
 
 	return nil
 }
+
+// Returns the error of a SysError event, or nil for other events.
+func sysError(ev zbus.Event) error {
+	if ev.Type != zbus.ErrorEvent || ev.Err != zbus.SysError {
+		return nil
+	}
+
+	if ev.Cause == nil {
+		return errors.New("unrecoverable bus error")
+	}
+
+	return ev.Cause
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2018 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// Opens the listener of the metrics endpoint. The endpoint is bound to localhost unless the address includes a host.
+func listenMetrics(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// Serves the statistics of the bus in the Prometheus text format at the /metrics path.
+func serveMetrics(ln net.Listener, b zbus.StatsProvider) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, b.Stats())
+	})
+
+	_ = http.Serve(ln, mux)
+}
+
+func writeMetrics(w io.Writer, s zbus.Stats) {
+	writeAddrMetric(w, "zbus_packets_sent_total", "Packets delivered to slaves.", s.Sent)
+	writeAddrMetric(w, "zbus_packets_received_total", "Packets received from slaves.", s.Received)
+
+	writeMetric(w, "zbus_nacks_total", "counter", "Transactions not acknowledged by slaves.", s.Nacks)
+	writeMetric(w, "zbus_crc_errors_total", "counter", "Corrupted packets.", s.CrcErrors)
+	writeMetric(w, "zbus_retries_total", "counter", "Repeated transactions.", s.Retries)
+	writeMetric(w, "zbus_discoveries_total", "counter", "Discovery cycles.", s.Discoveries)
+	writeMetric(w, "zbus_polls_total", "counter", "Poll transactions answered by slaves.", s.Polls)
+	writeMetric(w, "zbus_alert_limits_total", "counter", "Alert processing interrupted by the packet limit.",
+		s.AlertLimits)
+	writeMetric(w, "zbus_dropped_events_total", "counter", "Events dropped by the overflow policy.", s.DroppedEvents)
+	writeMetric(w, "zbus_queued_events", "gauge", "Events waiting for the consumer.", s.QueuedEvents)
+	writeMetric(w, "zbus_slaves", "gauge", "Registered slaves.", s.Slaves)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+}
+
+func writeAddrMetric(w io.Writer, name, help string, values map[zbus.Address]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	addrs := make([]int, 0, len(values))
+	for addr := range values {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "%s{addr=\"%02X\"} %v\n", name, addr, values[zbus.Address(addr)])
+	}
+}
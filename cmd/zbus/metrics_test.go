@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// fakeStats provides fixed statistics
+type fakeStats zbus.Stats
+
+func (s fakeStats) Stats() zbus.Stats {
+	return zbus.Stats(s)
+}
+
+var testStats = zbus.Stats{
+	Sent:          map[zbus.Address]uint64{0x1A: 3, 0x10: 5},
+	Received:      map[zbus.Address]uint64{0x10: 2},
+	Nacks:         1,
+	CrcErrors:     2,
+	Retries:       3,
+	Discoveries:   4,
+	Polls:         5,
+	AlertLimits:   6,
+	DroppedEvents: 7,
+	QueuedEvents:  8,
+	Slaves:        2,
+}
+
+const testMetrics = `# HELP zbus_packets_sent_total Packets delivered to slaves.
+# TYPE zbus_packets_sent_total counter
+zbus_packets_sent_total{addr="10"} 5
+zbus_packets_sent_total{addr="1A"} 3
+# HELP zbus_packets_received_total Packets received from slaves.
+# TYPE zbus_packets_received_total counter
+zbus_packets_received_total{addr="10"} 2
+# HELP zbus_nacks_total Transactions not acknowledged by slaves.
+# TYPE zbus_nacks_total counter
+zbus_nacks_total 1
+# HELP zbus_crc_errors_total Corrupted packets.
+# TYPE zbus_crc_errors_total counter
+zbus_crc_errors_total 2
+# HELP zbus_retries_total Repeated transactions.
+# TYPE zbus_retries_total counter
+zbus_retries_total 3
+# HELP zbus_discoveries_total Discovery cycles.
+# TYPE zbus_discoveries_total counter
+zbus_discoveries_total 4
+# HELP zbus_polls_total Poll transactions answered by slaves.
+# TYPE zbus_polls_total counter
+zbus_polls_total 5
+# HELP zbus_alert_limits_total Alert processing interrupted by the packet limit.
+# TYPE zbus_alert_limits_total counter
+zbus_alert_limits_total 6
+# HELP zbus_dropped_events_total Events dropped by the overflow policy.
+# TYPE zbus_dropped_events_total counter
+zbus_dropped_events_total 7
+# HELP zbus_queued_events Events waiting for the consumer.
+# TYPE zbus_queued_events gauge
+zbus_queued_events 8
+# HELP zbus_slaves Registered slaves.
+# TYPE zbus_slaves gauge
+zbus_slaves 2
+`
+
+// TestWriteMetrics tests the Prometheus exposition of bus statistics.
+func TestWriteMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	writeMetrics(&buf, testStats)
+
+	if buf.String() != testMetrics {
+		t.Errorf("Invalid metrics:\n%s", buf.String())
+	}
+}
+
+// TestServeMetrics tests the metrics endpoint.
+func TestServeMetrics(t *testing.T) {
+	ln, err := listenMetrics(":0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	go serveMetrics(ln, fakeStats(testStats))
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != testMetrics {
+		t.Errorf("Invalid response: %s, %v", body, err)
+	}
+
+	if typ := resp.Header.Get("Content-Type"); typ != "text/plain; version=0.0.4" {
+		t.Errorf("Invalid content type %v", typ)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	enchex "encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io/ioutil"
+	"strconv"
+)
+
+// policyFile is the JSON representation of the registration policy. Addresses are hex encoded, UDIDs and UDID
+// prefixes are hex strings.
+type policyFile struct {
+	Reserved map[string]string `json:"reserved"`
+	Allow    []string          `json:"allow"`
+	Deny     []string          `json:"deny"`
+	High     []string          `json:"high"`
+	Low      []string          `json:"low"`
+}
+
+func loadPolicy(path string) (zbus.Policy, error) {
+	var p zbus.Policy
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+
+	var f policyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+
+	p.Reserved = make(map[zbus.Address]zbus.Udid, len(f.Reserved))
+	for k, v := range f.Reserved {
+		addr, err := strconv.ParseUint(k, 16, 8)
+		if err != nil {
+			return p, fmt.Errorf("%s: invalid address %q", path, k)
+		}
+
+		var id zbus.Udid
+		b, err := enchex.DecodeString(v)
+		if err != nil || len(b) != len(id) {
+			return p, fmt.Errorf("%s: invalid UDID %q", path, v)
+		}
+
+		copy(id[:], b)
+		p.Reserved[zbus.Address(addr)] = id
+	}
+
+	if p.Allow, err = decodePrefixes(f.Allow); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if p.Deny, err = decodePrefixes(f.Deny); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if p.High, err = decodePrefixes(f.High); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if p.Low, err = decodePrefixes(f.Low); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return p, nil
+}
+
+func decodePrefixes(s []string) ([][]byte, error) {
+	var prefixes [][]byte
+	for _, x := range s {
+		b, err := enchex.DecodeString(x)
+		if err != nil || len(b) > len(zbus.Udid{}) {
+			return nil, fmt.Errorf("invalid UDID prefix %q", x)
+		}
+
+		prefixes = append(prefixes, b)
+	}
+
+	return prefixes, nil
+}
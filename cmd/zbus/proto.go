@@ -25,24 +25,48 @@ const (
 
 	// CmdPacket represents the "PKT" command.
 	CmdPacket = iota
+
+	// CmdList represents the "LIST" command.
+	CmdList = iota
+
+	// CmdInfo represents the "INFO" command.
+	CmdInfo = iota
+
+	// CmdClaim represents the "CLAIM" command.
+	CmdClaim = iota
+
+	// CmdRelease represents the "RELEASE" command.
+	CmdRelease = iota
 )
 
 // Command received by the protocol.
 type Command struct {
 	Type int
 	Pkt  zbus.Packet
+	Addr uint8
 }
 
 // Protocol defines a contract for reading and writing commands.
 type Protocol interface {
 	Read() (Command, error)
 	WriteVersion(ver string)
-	WriteError(addr uint8)
+	WriteError(addr uint8, err error)
 	WriteReset()
 	WritePacket(pkt zbus.Packet)
-	WriteConnect(addr uint8)
+	WriteConnect(addr uint8, dev *zbus.Device)
 	WriteDisconnect(addr uint8)
+	WriteReregister(addr uint8, dev *zbus.Device)
+	WriteOverflow(n int)
+	WriteList(devs []zbus.DeviceInfo)
+	WriteInfo(addr uint8, dev *zbus.DeviceInfo)
+	WriteClaim(addr uint8)
+	WriteRelease(addr uint8)
+	WriteBusy(addr uint8)
 }
 
 // ErrProto indicates a protocol violation error.
 var ErrProto = errors.New("protocol violation")
+
+// ErrCrc indicates a frame with a CRC mismatch. Unlike the other errors of Read, it does not end the input: the frame
+// is skipped and the next Read returns the next frame.
+var ErrCrc = errors.New("CRC mismatch")
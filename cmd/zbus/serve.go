@@ -0,0 +1,259 @@
+// Copyright (c) 2018 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// listener accepts clients of the server
+type listener struct {
+	net.Listener
+	format string // protocol of the clients
+}
+
+// listenFlags collects the -listen flags of the serve mode
+type listenFlags []string
+
+// server shares the bus with all connected clients
+type server struct {
+	bus    zbus.Bus
+	log    zbus.Logger
+	claims *claims
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+}
+
+func (l *listenFlags) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listenFlags) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Parses the arguments of the serve mode and opens the listeners. Returns the remaining bus arguments.
+func parseServe(args []string) ([]listener, []string) {
+	var specs listenFlags
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.Usage = printHelp
+	fs.Var(&specs, "listen", "")
+
+	if err := fs.Parse(args); err != nil {
+		os.Exit(exitUsage)
+	}
+
+	if len(specs) == 0 || fs.NArg() == 0 {
+		printErr("error: invalid 'serve' arguments\n")
+		os.Exit(exitUsage)
+	}
+
+	var lns []listener
+	for _, spec := range specs {
+		ln, err := listen(spec)
+		if err != nil {
+			printErr("error: %v\n", err)
+
+			for _, ln := range lns {
+				_ = ln.Close()
+			}
+			os.Exit(exitIOErr)
+		}
+
+		lns = append(lns, ln)
+	}
+
+	return lns, fs.Args()
+}
+
+// Opens the listener given by the "network:address[,format]" specification.
+func listen(spec string) (listener, error) {
+	s, format := spec, *format
+	if i := strings.LastIndexByte(spec, ','); i >= 0 {
+		s, format = spec[:i], spec[i+1:]
+	}
+
+	i := strings.IndexByte(s, ':')
+	if i < 0 || !validFormat(format) {
+		return listener{}, fmt.Errorf("invalid listener '%s'", spec)
+	}
+
+	network, addr := s[:i], s[i+1:]
+	if network != "unix" && network != "tcp" {
+		return listener{}, fmt.Errorf("invalid listener '%s'", spec)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil && network == "unix" && removeStale(addr) {
+		ln, err = net.Listen(network, addr)
+	}
+
+	if err != nil {
+		return listener{}, err
+	}
+
+	return listener{ln, format}, nil
+}
+
+// Removes the unix socket left by a previous instance. Reports whether the socket has been removed.
+func removeStale(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		// someone is listening
+		_ = conn.Close()
+		return false
+	}
+
+	return os.Remove(path) == nil
+}
+
+// Serves the clients until the bus terminates or the program is interrupted.
+func serve(b zbus.Bus, lns []listener, log zbus.Logger) int {
+	s := &server{bus: b, log: log, claims: newClaims(b), conns: make(map[net.Conn]struct{})}
+
+	for _, ln := range lns {
+		log.Log(zbus.InfoLevel, "listening", "listen", ln.Addr(), "format", ln.format)
+		go s.accept(ln)
+	}
+
+	var err error
+	done := interrupted()
+
+loop:
+	for {
+		// the clients receive events by their subscriptions
+		select {
+		case ev, ok := <-b.Events():
+			if !ok {
+				break loop
+			}
+
+			if err = sysError(ev); err != nil {
+				break loop
+			}
+
+		case <-done:
+			break loop
+		}
+	}
+
+	for _, ln := range lns {
+		_ = ln.Close()
+	}
+
+	shutdown(b, func(zbus.Event) {})
+	s.close()
+
+	if err != nil {
+		printErr("error: %v\n", err)
+		return exitIOErr
+	}
+
+	return 0
+}
+
+func (s *server) accept(ln listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// the listener has been closed
+			return
+		}
+
+		if !s.track(conn) {
+			_ = conn.Close()
+			return
+		}
+
+		go s.handle(conn, ln.format)
+	}
+}
+
+// Runs the client session.
+func (s *server) handle(conn net.Conn, format string) {
+	defer s.untrack(conn)
+
+	remote := conn.RemoteAddr().String()
+	s.log.Log(zbus.InfoLevel, "client connected", "remote", remote, "format", format)
+
+	events, cancel := s.bus.Subscribe()
+	defer cancel()
+
+	err := session(newProtocol(format, conn, conn), s.bus, s.claims, events, nil)
+	if err != nil && err != io.EOF && !s.isClosing() {
+		s.log.Log(zbus.WarnLevel, "client error", "remote", remote, "err", err)
+	}
+
+	s.log.Log(zbus.InfoLevel, "client disconnected", "remote", remote)
+}
+
+// Registers the client connection unless the server is closing.
+func (s *server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+
+	return true
+}
+
+func (s *server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = conn.Close()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+func (s *server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closing
+}
+
+// Disconnects all clients and waits for their sessions to end.
+func (s *server) close() {
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
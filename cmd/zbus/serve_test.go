@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/simslave"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient is a client of the server
+type testClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialClient(t *testing.T, path string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	return &testClient{conn, bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(t *testing.T, line string) {
+	t.Helper()
+
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// Reads lines until one contains the expected text.
+func (c *testClient) expect(t *testing.T, exp string) {
+	t.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q expected, got %v", exp, err)
+		}
+
+		if strings.Contains(line, exp) {
+			return
+		}
+	}
+}
+
+// TestListen tests parsing of listener specifications.
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zbus")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, x := range []struct {
+		spec   string
+		format string
+	}{
+		{"unix:" + filepath.Join(dir, "text.sock"), "text"},
+		{"unix:" + filepath.Join(dir, "json.sock") + ",json", "json"},
+		{"tcp:127.0.0.1:0,binary-crc", "binary-crc"},
+		{"tcp:127.0.0.1:0,xml", ""},
+		{"udp:127.0.0.1:0", ""},
+		{filepath.Join(dir, "plain.sock"), ""},
+	} {
+		ln, err := listen(x.spec)
+		if x.format == "" {
+			if err == nil {
+				_ = ln.Close()
+				t.Errorf("Invalid listener %q accepted", x.spec)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Listener %q failed: %v", x.spec, err)
+			continue
+		}
+
+		if ln.format != x.format {
+			t.Errorf("Invalid format of listener %q: %v", x.spec, ln.format)
+		}
+		_ = ln.Close()
+	}
+}
+
+// TestServe tests sharing of a simulated bus by two clients with different protocols.
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zbus")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := tmp.Addr().String()
+	_ = tmp.Close()
+
+	logger := zbus.NewLogger(log.New(ioutil.Discard, "", 0), zbus.ErrorLevel)
+	b, err := zbus.NewSimBus(addr, zbus.WithLogger(logger))
+	if err != nil {
+		t.Fatalf("Failed to create bus: %v", err)
+	}
+	defer b.Close()
+
+	var lns []listener
+	specs := []string{"unix:" + filepath.Join(dir, "text.sock"), "unix:" + filepath.Join(dir, "json.sock") + ",json"}
+	for _, spec := range specs {
+		ln, err := listen(spec)
+		if err != nil {
+			t.Fatalf("Listener %q failed: %v", spec, err)
+		}
+		lns = append(lns, ln)
+	}
+
+	res := make(chan int)
+	go func() {
+		res <- serve(b, lns, logger)
+	}()
+
+	text := dialClient(t, filepath.Join(dir, "text.sock"))
+	defer text.conn.Close()
+	text.expect(t, "ZBUS ")
+
+	js := dialClient(t, filepath.Join(dir, "json.sock"))
+	defer js.conn.Close()
+	js.expect(t, `"type":"version"`)
+
+	// both clients receive the events
+	s, err := simslave.Dial(addr, zbus.Udid{0x01})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer s.Close()
+
+	text.expect(t, fmt.Sprintf("CONN %02X", s.Addr()))
+	js.expect(t, `"type":"connect"`)
+
+	// the address is claimed by the first client
+	text.send(t, fmt.Sprintf("CLAIM %02X", s.Addr()))
+	text.expect(t, fmt.Sprintf("CLAIMED %02X", s.Addr()))
+
+	claim := fmt.Sprintf(`{"type": "claim", "addr": %d}`, s.Addr())
+	js.send(t, claim)
+	js.expect(t, `"type":"busy"`)
+
+	if err := s.Send([]byte{0x42}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	text.expect(t, fmt.Sprintf("PKT %02X 01", s.Addr()))
+
+	// the claim ends when its owner disconnects
+	_ = text.conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		js.send(t, claim)
+
+		line, err := js.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+
+		if strings.Contains(line, `"type":"claimed"`) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Claim not released: %v", line)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the clients are disconnected when the bus terminates
+	b.Close()
+	if code := <-res; code != 0 {
+		t.Errorf("Invalid exit code %v", code)
+	}
+
+	_ = js.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(js.r); err != nil {
+		t.Errorf("Connection not closed: %v", err)
+	}
+}
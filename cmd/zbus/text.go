@@ -19,6 +19,7 @@ import (
 	"github.com/omSquare/zen-bus/pkg/zbus"
 	"io"
 	"strconv"
+	"time"
 )
 
 const pktWidth = 32 // number of bytes per packet data line
@@ -33,6 +34,7 @@ type TextProtocol struct {
 	buf []byte
 	pos int
 	n   int
+	max int // maximum length of a packet
 }
 
 // NewTextProtocol creates a new TextProtocol for the specified reader and writer.
@@ -41,6 +43,7 @@ func NewTextProtocol(r io.Reader, w io.Writer) *TextProtocol {
 		r:   r,
 		w:   w,
 		buf: make([]byte, 1024),
+		max: zbus.MaxPacketSize,
 	}
 }
 
@@ -52,7 +55,7 @@ func (p *TextProtocol) WriteVersion(ver string) {
 }
 
 // WriteError outputs the "ERR" command.
-func (p *TextProtocol) WriteError(addr uint8) {
+func (p *TextProtocol) WriteError(addr uint8, _ error) {
 	fmt.Fprintf(p.w, "ERR %02X\n", addr)
 }
 
@@ -87,7 +90,7 @@ func (p *TextProtocol) WritePacket(pkt zbus.Packet) {
 }
 
 // WriteConnect outputs the "CONN" command.
-func (p *TextProtocol) WriteConnect(addr uint8) {
+func (p *TextProtocol) WriteConnect(addr uint8, _ *zbus.Device) {
 	fmt.Fprintf(p.w, "CONN %02X\n", addr)
 }
 
@@ -96,6 +99,59 @@ func (p *TextProtocol) WriteDisconnect(addr uint8) {
 	fmt.Fprintf(p.w, "DISC %02X\n", addr)
 }
 
+// WriteReregister outputs the "REREG" command.
+func (p *TextProtocol) WriteReregister(addr uint8, _ *zbus.Device) {
+	fmt.Fprintf(p.w, "REREG %02X\n", addr)
+}
+
+// WriteOverflow outputs the "OVF" command.
+func (p *TextProtocol) WriteOverflow(n int) {
+	fmt.Fprintf(p.w, "OVF %X\n", n)
+}
+
+// WriteList outputs the "LIST" command followed by a "DEV" command for every device.
+func (p *TextProtocol) WriteList(devs []zbus.DeviceInfo) {
+	fmt.Fprintf(p.w, "LIST %02X\n", len(devs))
+	for i := range devs {
+		p.writeDevice(&devs[i])
+	}
+}
+
+// WriteInfo outputs the "DEV" command, or the "NODEV" command if there is no such device.
+func (p *TextProtocol) WriteInfo(addr uint8, dev *zbus.DeviceInfo) {
+	if dev == nil {
+		fmt.Fprintf(p.w, "NODEV %02X\n", addr)
+		return
+	}
+
+	p.writeDevice(dev)
+}
+
+// WriteClaim outputs the "CLAIMED" command.
+func (p *TextProtocol) WriteClaim(addr uint8) {
+	fmt.Fprintf(p.w, "CLAIMED %02X\n", addr)
+}
+
+// WriteRelease outputs the "RELEASED" command.
+func (p *TextProtocol) WriteRelease(addr uint8) {
+	fmt.Fprintf(p.w, "RELEASED %02X\n", addr)
+}
+
+// WriteBusy outputs the "BUSY" command reporting an address claimed by another client.
+func (p *TextProtocol) WriteBusy(addr uint8) {
+	fmt.Fprintf(p.w, "BUSY %02X\n", addr)
+}
+
+func (p *TextProtocol) writeDevice(dev *zbus.DeviceInfo) {
+	state := "IDLE"
+	if dev.Active {
+		state = "ACTIVE"
+	}
+
+	fmt.Fprintf(p.w, "DEV %02X %X %v %v %v\n", dev.Addr, dev.Dev.Id, dev.Registered.UTC().Format(time.RFC3339),
+		dev.LastSeen.UTC().Format(time.RFC3339), state)
+}
+
 // Read reads the next command form the protocol input.
 func (p *TextProtocol) Read() (Command, error) {
 	// read command token first
@@ -111,6 +167,29 @@ func (p *TextProtocol) Read() (Command, error) {
 	case "PKT":
 		return p.readPacket()
 
+	case "LIST":
+		return Command{Type: CmdList}, nil
+
+	case "INFO":
+		addr, err := p.nextByte()
+		if err != nil {
+			return Command{}, ErrProto
+		}
+
+		return Command{Type: CmdInfo, Addr: addr}, nil
+
+	case "CLAIM", "RELEASE":
+		addr, err := p.nextByte()
+		if err != nil {
+			return Command{}, ErrProto
+		}
+
+		if cmd == "CLAIM" {
+			return Command{Type: CmdClaim, Addr: addr}, nil
+		}
+
+		return Command{Type: CmdRelease, Addr: addr}, nil
+
 	default:
 		return Command{}, ErrProto
 	}
@@ -123,18 +202,19 @@ func (p *TextProtocol) readPacket() (Command, error) {
 		return Command{}, ErrProto
 	}
 
-	n, err := p.nextByte()
+	tok, err := p.nextToken()
 	if err != nil {
 		return Command{}, ErrProto
 	}
 
 	// validate length
-	if n < 1 || n > zbus.MaxPacketSize {
+	n, err := strconv.ParseUint(tok, 16, 16)
+	if err != nil || n < 1 || int(n) > p.max {
 		return Command{}, ErrProto
 	}
 
 	// read data
-	pkt := zbus.Packet{addr, make([]uint8, n)}
+	pkt := zbus.Packet{Addr: addr, Data: make([]uint8, n)}
 	for i := 0; i < len(pkt.Data); {
 		tok, err := p.nextToken()
 		if err != nil || len(tok)%2 == 1 || i+len(tok)/2 > len(pkt.Data) {
@@ -16,65 +16,133 @@ package zbus
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
 const (
-	minAddr Address = 0x10 // the lower bound of the slave address space (inclusive)
-	maxAddr Address = 0x50 // the upper bound of the slave address space (exclusive)
+	minAddr Address = 0x10 // the default lower bound of the slave address space (inclusive)
+	maxAddr Address = 0x50 // the default upper bound of the slave address space (exclusive)
 
-	numAddr = maxAddr - minAddr
-
-	silenceLimit = 5 * time.Second
+	silenceLimit = 5 * time.Second // the default silence timeout
 )
 
 var (
 	errTooManySlaves = errors.New("too many slaves")
 )
 
-// state of the address resolution protocol
+// state of the address resolution protocol, it is modified by the work loop of a bus only, the mutex guards the
+// modifications against devices and device which are called without the work loop
 type arp struct {
-	// array of all slaves indexed by their address offset (index + minAddr == addr)
-	slaves [numAddr]*slave
+	mu sync.Mutex
+
+	// all slaves indexed by their address offset (index + min == addr)
+	slaves []*slave
 
 	// current number of slaves
 	num int
+
+	min     Address       // lower bound of the address space (inclusive)
+	max     Address       // upper bound of the address space (exclusive)
+	limit   int           // maximum number of slaves
+	silence time.Duration // time after which a silent slave becomes inactive
+	leases  *leases       // previously assigned addresses (might be nil)
+	policy  *Policy       // registration policy (might be nil)
+	keep    bool          // re-registered slaves keep their address
 }
 
 type slave struct {
-	addr     Address
-	id       Udid
-	lastSeen time.Time
+	addr       Address
+	idx        int
+	id         Udid
+	registered time.Time
+	lastSeen   time.Time
+	silence    time.Duration
+	prio       Priority
+}
+
+// Creates an empty ARP configured according to the bus configuration.
+func newArp(c *config) arp {
+	return arp{
+		slaves:  make([]*slave, c.maxAddr-c.minAddr),
+		min:     c.minAddr,
+		max:     c.maxAddr,
+		limit:   c.maxSlaves,
+		silence: c.silence,
+		leases:  c.leases,
+		policy:  c.policy,
+		keep:    c.rereg == KeepAddress,
+	}
 }
 
-func (a *arp) register(dev *Device) (*slave, error) {
+// Initializes a zero value ARP with the default configuration.
+func (a *arp) init() {
+	if a.slaves != nil {
+		return
+	}
+
+	c := newConfig(nil)
+	*a = newArp(&c)
+}
+
+// Registers the device. If the device has already been registered, the previous slave is returned as well: it is
+// either the same slave if re-registered slaves keep their address, or a slave that has been unregistered.
+func (a *arp) register(dev *Device) (s *slave, prev *slave, err error) {
+	a.init()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.policy.admit(dev.Id); err != nil {
+		return nil, nil, err
+	}
+
+	dev.Priority = a.policy.priority(dev)
+
 	// first check if the device is not already registered
-	if s := a.findSlave(dev.Id); s != nil {
-		// unregister it
-		// TODO(mbenda): notify client
-		// TODO(mbenda): just replace instead?
-		a.unregister(s)
+	if prev = a.findSlave(dev.Id); prev != nil {
+		if a.keep {
+			prev.prio = dev.Priority
+			prev.touch()
+			prev.registered = prev.lastSeen
+
+			return prev, prev, nil
+		}
+
+		a.remove(prev)
 	}
 
 	// find a new slot (address)
-	s, err := a.findAddr()
+	s, err = a.findAddr(dev.Id, dev.Priority)
 	if err != nil {
-		return nil, err
+		return nil, prev, err
 	}
 
 	a.num++
 	s.id = dev.Id
+	s.prio = dev.Priority
 	s.touch()
+	s.registered = s.lastSeen
 
-	return s, nil
+	return s, prev, nil
 }
 
 func (a *arp) unregister(s *slave) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.remove(s)
+}
+
+// unregisters the slave, the caller holds the mutex
+func (a *arp) remove(s *slave) {
 	if s == nil {
 		return
 	}
 
-	if a.slaves[s.index()] == s {
+	if s.index() < len(a.slaves) && a.slaves[s.index()] == s {
 		a.slaves[s.index()] = nil
 		a.num--
 	}
@@ -90,36 +158,169 @@ func (a *arp) findSlave(id Udid) *slave {
 	return nil
 }
 
-// finds a free address and allocates a slave
-func (a *arp) findAddr() (*slave, error) {
-	if a.num == MaxSlaves {
+// finds a free address and allocates a slave, the address previously leased to the device is preferred
+func (a *arp) findAddr(id Udid, prio Priority) (*slave, error) {
+	if a.num >= a.limit {
 		return nil, errTooManySlaves
 	}
 
-	// TODO(mbenda): slave priorities
-	for i, s := range a.slaves {
-		if s != nil {
-			continue
+	if addr, ok := a.policy.reservation(id); ok {
+		if a.slaves[addr-a.min] != nil {
+			return nil, fmt.Errorf("%s: %w", udidString(id), ErrReserved)
 		}
 
-		// an empty slot was found
-		a.slaves[i] = &slave{addr: minAddr + Address(i)}
-		return a.slaves[i], nil
+		return a.alloc(int(addr - a.min)), nil
+	}
+
+	if addr, ok := a.leases.addr(id); ok && a.available(addr, id) {
+		return a.alloc(int(addr - a.min)), nil
+	}
+
+	// prefer addresses not leased to other devices
+	order := a.order(prio)
+	for _, free := range []bool{true, false} {
+		for _, i := range order {
+			addr := a.min + Address(i)
+			if !a.available(addr, id) || (free && a.leases.leased(addr, id)) {
+				continue
+			}
+
+			// an empty slot was found
+			return a.alloc(i), nil
+		}
 	}
 
 	return nil, errTooManySlaves
 }
 
+// returns the order in which slots are offered to a slave of the given priority: high priority slaves get the lowest
+// addresses, normal ones the addresses above the band of high priority ones (if the policy declares any) and low
+// priority slaves the highest ones
+func (a *arp) order(prio Priority) []int {
+	n := len(a.slaves)
+	order := make([]int, n)
+
+	switch {
+	case prio > NormalPriority:
+		for i := range order {
+			order[i] = i
+		}
+
+	case prio < NormalPriority:
+		for i := range order {
+			order[i] = n - 1 - i
+		}
+
+	default:
+		band := 0
+		if a.policy != nil && len(a.policy.High) > 0 {
+			band = highBand
+			if band > n/4 {
+				band = n / 4
+			}
+		}
+
+		for i := range order {
+			order[i] = (band + i) % n
+		}
+	}
+
+	return order
+}
+
+// reports whether the address is in range, free and not reserved for another device
+func (a *arp) available(addr Address, id Udid) bool {
+	return addr >= a.min && addr < a.max && a.slaves[addr-a.min] == nil && !a.policy.reserved(addr, id)
+}
+
+// allocates a slave in the empty slot
+func (a *arp) alloc(i int) *slave {
+	a.slaves[i] = &slave{addr: a.min + Address(i), idx: i, silence: a.silence}
+	return a.slaves[i]
+}
+
 func (a *arp) slave(addr Address) *slave {
-	return a.slaves[addr-minAddr]
+	if addr < a.min || addr >= a.max || a.slaves == nil {
+		return nil
+	}
+
+	return a.slaves[addr-a.min]
+}
+
+// Unregisters all slaves.
+func (a *arp) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.slaves = make([]*slave, a.max-a.min)
+	a.num = 0
+}
+
+// Updates the time the slave has been seen.
+func (a *arp) touch(s *slave) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s.touch()
+}
+
+// returns information about all registered slaves ordered by address
+func (a *arp) devices() []DeviceInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	devs := make([]DeviceInfo, 0, a.num)
+	for _, s := range a.slaves {
+		if s != nil {
+			devs = append(devs, s.info())
+		}
+	}
+	return devs
+}
+
+// returns information about the slave with the given address
+func (a *arp) device(addr Address) (DeviceInfo, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if s := a.slave(addr); s != nil {
+		return s.info(), true
+	}
+	return DeviceInfo{}, false
+}
+
+// returns the registered slaves ordered by priority and address
+func (a *arp) byPriority() []*slave {
+	slaves := make([]*slave, 0, a.num)
+	for _, s := range a.slaves {
+		if s != nil {
+			slaves = append(slaves, s)
+		}
+	}
+
+	sort.SliceStable(slaves, func(i, j int) bool {
+		return slaves[i].prio > slaves[j].prio
+	})
+
+	return slaves
+}
+
+func (s *slave) info() DeviceInfo {
+	return DeviceInfo{
+		Addr:       s.addr,
+		Dev:        Device{Id: s.id, Priority: s.prio},
+		Registered: s.registered,
+		LastSeen:   s.lastSeen,
+		Active:     s.active(),
+	}
 }
 
 func (s *slave) index() int {
-	return int(s.addr - minAddr)
+	return s.idx
 }
 
 func (s *slave) active() bool {
-	return time.Now().Sub(s.lastSeen) < silenceLimit
+	return time.Now().Sub(s.lastSeen) < s.silence
 }
 
 func (s *slave) touch() {
@@ -11,7 +11,7 @@ func TestRegistration(t *testing.T) {
 
 	// register 1st slave
 	dev1 := Device{Id: [8]byte{0x01, 0x03, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}}
-	s1, err := a.register(&dev1)
+	s1, _, err := a.register(&dev1)
 	if err != nil || s1 == nil {
 		t.Fatalf("Failed to register device")
 	}
@@ -32,7 +32,7 @@ func TestRegistration(t *testing.T) {
 
 	// register 2nd slave
 	dev2 := Device{Id: [8]byte{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 0x00, 0x00}}
-	s2, err := a.register(&dev2)
+	s2, _, err := a.register(&dev2)
 	if err != nil || s2 == nil {
 		t.Fatalf("Failed to register device")
 	}
@@ -67,3 +67,86 @@ func TestRegistration(t *testing.T) {
 		t.Errorf("2nd slave not registered")
 	}
 }
+
+// TestAddrRange tests that slaves are registered within the configured address range and limit.
+func TestAddrRange(t *testing.T) {
+	c := newConfig([]Option{WithAddrRange(0x20, 0x24), WithMaxSlaves(2)})
+	if err := c.check(); err != nil {
+		t.Fatalf("Invalid configuration: %v", err)
+	}
+
+	a := newArp(&c)
+
+	for i := 0; i < 2; i++ {
+		s, _, err := a.register(&Device{Id: [8]byte{byte(i)}})
+		if err != nil {
+			t.Fatalf("Failed to register device")
+		}
+
+		if s.addr != 0x20+Address(i) {
+			t.Errorf("Slave registered with address %02x, %02x expected", s.addr, 0x20+i)
+		}
+	}
+
+	if _, _, err := a.register(&Device{Id: [8]byte{0xFF}}); err != errTooManySlaves {
+		t.Errorf("Slave limit not enforced")
+	}
+
+	if a.slave(0x10) != nil || a.slave(0x24) != nil {
+		t.Errorf("Slave found outside of the address range")
+	}
+}
+
+// TestDevices tests querying of registered slaves.
+func TestDevices(t *testing.T) {
+	a := &arp{}
+	if devs := a.devices(); len(devs) != 0 {
+		t.Fatalf("A brand new ARP contains devices")
+	}
+
+	dev1 := Device{Id: [8]byte{0x01}}
+	dev2 := Device{Id: [8]byte{0x02}}
+
+	s1, _, _ := a.register(&dev1)
+	s2, _, _ := a.register(&dev2)
+
+	devs := a.devices()
+	if len(devs) != 2 {
+		t.Fatalf("Invalid number of devices, 2 expected, got %v", len(devs))
+	}
+
+	for i, s := range []*slave{s1, s2} {
+		info := devs[i]
+		if info.Addr != s.addr || info.Dev.Id != s.id || !info.Active {
+			t.Errorf("Invalid device info %+v", info)
+		}
+
+		if info.Registered.IsZero() || info.LastSeen.Before(info.Registered) {
+			t.Errorf("Invalid device times %+v", info)
+		}
+	}
+}
+
+// TestReregistration tests registration of an already registered device.
+func TestReregistration(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		a := &arp{}
+		a.init()
+		a.keep = keep
+
+		dev := Device{Id: [8]byte{0x01}}
+		s1, _, _ := a.register(&dev)
+		s2, prev, err := a.register(&dev)
+		if err != nil || prev != s1 {
+			t.Fatalf("Previous registration not reported: %v, %v", prev, err)
+		}
+
+		if keep != (s1 == s2) || a.num != 1 {
+			t.Errorf("Invalid re-registration (keep %v): %v, %v", keep, s1, s2)
+		}
+
+		if a.slave(s2.addr) != s2 {
+			t.Errorf("Re-registered slave not found")
+		}
+	}
+}
@@ -14,6 +14,13 @@
 
 package zbus
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
 const (
 	// Version contains the zen-bus version.
 	Version = "0.1.0"
@@ -24,13 +31,16 @@ const (
 	// MaxPin is the maximum number of a GPIO alert pin.
 	MaxPin = 999
 
+	// MaxGpioChip is the maximum number of a GPIO character device.
+	MaxGpioChip = 99
+
 	// MaxPacketSize defines the maximum payload size of a packet.
 	MaxPacketSize = 128
 
-	// EventCapacity defines the size of the Events channel.
+	// EventCapacity defines the default size of the Events channel.
 	EventCapacity = 8
 
-	// MaxSlaves determines the maximum number of connected slave devices.
+	// MaxSlaves determines the default maximum number of connected slave devices.
 	MaxSlaves = 32
 )
 
@@ -44,6 +54,16 @@ const (
 	// PollAddr is a broadcast address that all registered slaves listen on. Any slave device that has data to send will
 	// answer this address.
 	PollAddr Address = 0x77
+
+	// ParkAddr is assigned to devices rejected by the registration policy. The bus never talks to this address, so the
+	// rejected devices stay out of the arbitration of ConfAddr until the next bus reset.
+	ParkAddr Address = 0x7F
+)
+
+const (
+	// commands sent to the general call address
+	callReset uint8 = 0x00 // all slaves lose their configuration
+	callQuit  uint8 = 0xFF // the master leaves the bus, slaves lose their configuration
 )
 
 const (
@@ -61,11 +81,19 @@ const (
 
 	// DisconnectEvent indicates that a device disconnected from the bus.
 	DisconnectEvent eventType = iota
+
+	// ReregisterEvent indicates that a connected device registered again and kept its address, e.g. after its reboot.
+	// Any state of the device held by the client should be reset.
+	ReregisterEvent eventType = iota
+
+	// OverflowEvent indicates that events have been dropped because the consumer of the Events channel did not keep
+	// up with the bus. The Dropped field holds the number of lost events.
+	OverflowEvent eventType = iota
 )
 
 const (
 	// SysError represents an unrecoverable system error that prevents the bus from functioning properly. The client
-	// must close the bus after receiving this error event. TODO proper error passing.
+	// must close the bus after receiving this error event. The Cause field of the event holds the underlying error.
 	SysError errorType = iota
 
 	// BusError indicates that a generic bus error occurred.
@@ -81,19 +109,68 @@ const (
 	RegError errorType = iota
 )
 
+var (
+	// ErrClosed is returned when an operation cannot complete because the bus has been closed.
+	ErrClosed = errors.New("bus closed")
+
+	// ErrAck is returned when a slave did not acknowledge a packet.
+	ErrAck = errors.New("packet not acknowledged")
+
+	// ErrNoSlave is returned when no slave with the destination address is connected.
+	ErrNoSlave = errors.New("unknown slave address")
+
+	// ErrSys is the sentinel error of SysError events.
+	ErrSys = errors.New("unrecoverable system error")
+
+	// ErrBus is the sentinel error of BusError events.
+	ErrBus = errors.New("bus error")
+
+	// ErrCrc is the sentinel error of CrcError events.
+	ErrCrc = errors.New("CRC error")
+
+	// ErrReg is the sentinel error of RegError events.
+	ErrReg = errors.New("slave registration failed")
+)
+
 // Bus holds a channel that delivers asynchronous bus events.
 type Bus interface {
-	// Close closes the bus.
+	// Close closes the bus immediately, the work that has not been done yet is abandoned.
 	Close()
 
-	// Reset resets the state of the bus asynchronously.
+	// Shutdown closes the bus gracefully. It stops accepting new work, finishes the work submitted so far (e.g.
+	// delivers the packets passed to Send), notifies the slaves that the master leaves the bus and waits until all
+	// resources are released. It returns nil once the bus is closed, or the error of the context if it ends first;
+	// Close can be used to terminate the bus then.
+	Shutdown(ctx context.Context) error
+
+	// Reset resets the state of the bus asynchronously. It does nothing once the bus is shutting down or closed.
 	Reset()
 
-	// Send sends a packet on the bus asynchronously.
+	// Send sends a packet on the bus asynchronously. Packets sent once the bus is shutting down or closed are dropped.
 	Send(pkt Packet)
 
-	// Events provides access to bus events.
+	// SendSync sends a packet on the bus and waits for the result of the delivery. It returns nil if the slave
+	// acknowledged the packet, ErrAck if it did not, ErrNoSlave if there is no such slave, ErrBus if the bus has been
+	// reset before the packet could be delivered and ErrClosed if the bus has been closed.
+	SendSync(ctx context.Context, pkt Packet) error
+
+	// Events provides access to bus events. With the Block overflow policy, the consumer must keep reading the
+	// channel, otherwise the bus stalls, even if all events are consumed by subscribers.
 	Events() <-chan Event
+
+	// Subscribe returns a separate channel of the events selected by all the filters and a function that cancels the
+	// subscription. Subscriber channels never block the bus: a subscriber that does not keep up loses the events that
+	// do not fit into its channel, they are reported by an OverflowEvent. Subscriptions do not affect the overflow
+	// policy of the Events channel.
+	Subscribe(filters ...Filter) (<-chan Event, func())
+
+	// Devices returns information about all registered slaves ordered by their addresses. It returns nil if the bus
+	// has been closed.
+	Devices() []DeviceInfo
+
+	// Device returns information about the slave with the given address. The flag reports whether such a slave is
+	// registered.
+	Device(addr Address) (DeviceInfo, bool)
 }
 
 // Event represents an asynchronous bus event.
@@ -103,6 +180,20 @@ type Event struct {
 	Addr Address
 	Pkt  *Packet
 	Dev  *Device
+
+	// Cause holds the *Error describing an ErrorEvent.
+	Cause error
+
+	// Dropped is the number of events lost before an OverflowEvent.
+	Dropped int
+}
+
+// Error describes an asynchronous bus error. It matches the sentinel error of its type (e.g. ErrAck for AckError)
+// when used with errors.Is and unwraps to the underlying cause.
+type Error struct {
+	Type errorType
+	Addr Address
+	Err  error
 }
 
 // Address of a slave device.
@@ -125,10 +216,241 @@ type Udid = [8]byte
 // Device is a slave device descriptor.
 type Device struct {
 	Id Udid
+
+	// Priority is the priority class of the device.
+	Priority Priority
 	// TODO(mbenda): flags, serial number etc.
 }
 
+// DeviceInfo describes a registered slave device.
+type DeviceInfo struct {
+	Addr Address
+	Dev  Device
+
+	// Registered is the time when the slave registered.
+	Registered time.Time
+
+	// LastSeen is the time of the last successful transaction with the slave.
+	LastSeen time.Time
+
+	// Active reports whether the slave has communicated recently, i.e. within the silence timeout.
+	Active bool
+}
+
 type eventType byte
 type errorType byte
 
-// TODO(mbenda): logging
+// Error returns the error message including the underlying cause.
+func (e *Error) Error() string {
+	msg := e.Type.sentinel().Error()
+
+	if e.Addr != 0 {
+		msg = fmt.Sprintf("%v (address %02X)", msg, e.Addr)
+	}
+
+	if e.Err != nil && e.Err != e.Type.sentinel() {
+		msg = fmt.Sprintf("%v: %v", msg, e.Err)
+	}
+
+	return msg
+}
+
+// Event returns an error event reporting the error.
+func (e *Error) Event() Event {
+	return Event{Type: ErrorEvent, Err: e.Type, Addr: e.Addr, Cause: e}
+}
+
+// Is reports whether the target is the sentinel error of the error type.
+func (e *Error) Is(target error) bool {
+	return target == e.Type.sentinel()
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (t errorType) sentinel() error {
+	switch t {
+	case SysError:
+		return ErrSys
+	case AckError:
+		return ErrAck
+	case CrcError:
+		return ErrCrc
+	case RegError:
+		return ErrReg
+	default:
+		return ErrBus
+	}
+}
+
+// Creates an ErrorEvent of the given type, the cause might be nil.
+func errorEvent(t errorType, addr Address, cause error) Event {
+	return (&Error{t, addr, cause}).Event()
+}
+
+// Queries the ARP of a bus without its work loop, so that a busy bus answers at once. Returns nil if the bus has been
+// closed.
+func devices(term <-chan struct{}, a *arp) []DeviceInfo {
+	if stopped(term) {
+		return nil
+	}
+	return a.devices()
+}
+
+// Queries the slave of a bus without its work loop.
+func device(term <-chan struct{}, a *arp, addr Address) (DeviceInfo, bool) {
+	if stopped(term) {
+		return DeviceInfo{}, false
+	}
+	return a.device(addr)
+}
+
+// Submits the work to the work loop of a bus unless the bus is shutting down or closed. It reports whether the work
+// has been accepted.
+func submit(work chan<- func() error, stop, term <-chan struct{}, fn func() error) bool {
+	if stopped(stop) {
+		return false
+	}
+
+	select {
+	case work <- fn:
+		return true
+
+	case <-term:
+		return false
+	}
+}
+
+// Reports whether the bus is shutting down or closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Runs the work of all submitters waiting for the work loop of a bus, used when the bus is shutting down. Returns the
+// first unrecoverable error.
+func drain(work <-chan func() error) error {
+	for {
+		select {
+		case fn := <-work:
+			if err := fn(); err != nil {
+				return err
+			}
+
+		default:
+			return nil
+		}
+	}
+}
+
+// Waits until the bus work loop terminates or the context ends. The error is the result of the shutdown operation.
+func awaitShutdown(ctx context.Context, term <-chan struct{}, err error) error {
+	if err != nil && err != ErrClosed {
+		return err
+	}
+
+	select {
+	case <-term:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Runs the operation in the work loop of a bus and waits for its result. Like any work, the operation returns an
+// unrecoverable error that terminates the work loop. Its result is reported by calling the done function once.
+func invoke(ctx context.Context, work chan<- func() error, term <-chan struct{},
+	op func(done func(error)) error) error {
+	res := make(chan error, 1)
+	fn := func() error {
+		err := op(func(r error) {
+			res <- r
+		})
+
+		if err != nil {
+			select {
+			case res <- err:
+				break
+			default:
+				// the result has already been reported
+			}
+		}
+
+		return err
+	}
+
+	select {
+	case work <- fn:
+		break
+
+	case <-term:
+		return ErrClosed
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case r := <-res:
+		return r
+
+	case <-term:
+		// the operation might have terminated the loop
+		select {
+		case r := <-res:
+			return r
+		default:
+			return ErrClosed
+		}
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// String returns the name of the event type.
+func (t eventType) String() string {
+	switch t {
+	case ResetEvent:
+		return "reset"
+	case PacketEvent:
+		return "packet"
+	case ErrorEvent:
+		return "error"
+	case ConnectEvent:
+		return "connect"
+	case DisconnectEvent:
+		return "disconnect"
+	case ReregisterEvent:
+		return "reregister"
+	case OverflowEvent:
+		return "overflow"
+	default:
+		return fmt.Sprintf("event(%d)", byte(t))
+	}
+}
+
+// String returns the name of the error type.
+func (t errorType) String() string {
+	switch t {
+	case SysError:
+		return "sys"
+	case BusError:
+		return "bus"
+	case AckError:
+		return "ack"
+	case CrcError:
+		return "crc"
+	case RegError:
+		return "reg"
+	default:
+		return fmt.Sprintf("error(%d)", byte(t))
+	}
+}
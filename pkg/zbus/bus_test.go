@@ -0,0 +1,37 @@
+package zbus
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+// TestErrorEvent tests that error events carry a cause usable with errors.Is and errors.As.
+func TestErrorEvent(t *testing.T) {
+	ev := errorEvent(SysError, 0, syscall.ENODEV)
+
+	if !errors.Is(ev.Cause, ErrSys) {
+		t.Errorf("Cause does not match ErrSys")
+	}
+
+	if !errors.Is(ev.Cause, syscall.ENODEV) {
+		t.Errorf("Cause does not match the underlying error")
+	}
+
+	if errors.Is(ev.Cause, ErrAck) {
+		t.Errorf("Cause matches an unrelated sentinel")
+	}
+
+	ev = errorEvent(AckError, 0x12, ErrNoSlave)
+
+	var e *Error
+	if !errors.As(ev.Cause, &e) || e.Type != AckError || e.Addr != 0x12 {
+		t.Fatalf("Cause is not a valid *Error: %v", ev.Cause)
+	}
+
+	if !errors.Is(ev.Cause, ErrAck) || !errors.Is(ev.Cause, ErrNoSlave) {
+		t.Errorf("Cause does not match ErrAck and ErrNoSlave")
+	}
+
+	t.Logf("Error message: %v", ev.Cause)
+}
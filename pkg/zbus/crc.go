@@ -0,0 +1,61 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+// CRC-8 lookup table for the polynomial x^8 + x^2 + x + 1 (0x07)
+var crcTable = func() (t [256]uint8) {
+	for i := range t {
+		crc := uint8(i)
+		for j := 0; j < 8; j++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return
+}()
+
+// Updates the CRC-8 checksum with the data.
+func crc8(crc uint8, data []byte) uint8 {
+	for _, b := range data {
+		crc = crcTable[crc^b]
+	}
+	return crc
+}
+
+// CRC8 computes the CRC-8 checksum of the data using the polynomial of the SMBus packet error code (x^8 + x^2 + x + 1).
+func CRC8(data []byte) uint8 {
+	return crc8(0, data)
+}
+
+// PEC computes the CRC-8 trailer of a packet protected by CRC (see WithCRC). The read flag is set for packets sent by
+// the slave with the given address and cleared for packets sent to it.
+func PEC(addr Address, read bool, data []byte) uint8 {
+	return pec(addr, read, data)
+}
+
+// Computes the SMBus packet error code of a transaction. It covers the address byte (including the R/W bit) and all
+// data bytes.
+func pec(addr Address, read bool, data []byte) uint8 {
+	ab := addr << 1
+	if read {
+		ab |= 1
+	}
+
+	return crc8(crcTable[ab], data)
+}
@@ -0,0 +1,32 @@
+package zbus
+
+import "testing"
+
+// TestCrc8 tests the CRC-8 implementation against known check values.
+func TestCrc8(t *testing.T) {
+	if crc := crc8(0, []byte("123456789")); crc != 0xF4 {
+		t.Errorf("Invalid CRC-8 check value %02x, f4 expected", crc)
+	}
+
+	// the PEC of a transaction equals the CRC of the address byte followed by data
+	data := []byte{0x01, 0x02, 0x03}
+	if pec(0x12, true, data) != crc8(0, []byte{0x25, 0x01, 0x02, 0x03}) {
+		t.Errorf("Invalid read PEC")
+	}
+
+	if pec(0x12, false, data) != crc8(0, []byte{0x24, 0x01, 0x02, 0x03}) {
+		t.Errorf("Invalid write PEC")
+	}
+}
+
+// TestCRC8 tests the exported checksum functions.
+func TestCRC8(t *testing.T) {
+	if crc := CRC8([]byte("123456789")); crc != 0xF4 {
+		t.Errorf("Invalid CRC-8 check value %02x, f4 expected", crc)
+	}
+
+	data := []byte{0x01, 0x02, 0x03}
+	if PEC(0x12, true, data) != pec(0x12, true, data) || PEC(0x12, false, data) != pec(0x12, false, data) {
+		t.Errorf("Invalid PEC")
+	}
+}
@@ -16,6 +16,11 @@
 Package zbus provides master-side link-layer implementation of the zen-bus wire protocol.
 
 The main entry point is the New function that initializes and returns a reference to Bus.
-Bus operations are executed asynchronously and results are communicated via the Events channel.
+Bus operations are executed asynchronously and results are communicated via the Events channel. The SendSync
+method can be used instead of Send to wait for the delivery result of a particular packet.
+Components that need their own view of bus events can use Subscribe to get separate, optionally filtered, event
+channels. Subscriber channels never block the bus, they lose the events their subscribers do not keep up with. The
+Events channel follows the overflow policy of the bus, so with the default Block policy it has to be read even by a
+client that only uses subscriptions.
 */
 package zbus
@@ -0,0 +1,321 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// Block makes the bus wait until the consumer makes room in the Events channel. A slow consumer stalls the bus,
+	// subscriptions do not change that: the Events channel has to be read even if the events are consumed by
+	// subscribers only.
+	Block Overflow = iota
+
+	// DropOldest drops the oldest queued event to make room for a new one.
+	DropOldest
+
+	// DropNewest drops new events until the consumer makes room in the queue.
+	DropNewest
+
+	// Coalesce replaces the latest queued event of the same type and address (and error type for error events) by
+	// the new event, e.g. only the latest packet of every slave is kept. The oldest event is dropped if there is no
+	// such event.
+	Coalesce
+)
+
+// Overflow determines what happens when the consumer of the Events channel does not keep up with the bus. With the
+// exception of Block, events are queued in the bus and dropped when the queue is full. Lost events are reported by an
+// OverflowEvent delivered as soon as the consumer reads from the channel.
+type Overflow int
+
+// WithOverflow sets the overflow policy of the Events channel. The default policy is Block.
+func WithOverflow(o Overflow) Option {
+	return func(c *config) {
+		c.overflow = o
+	}
+}
+
+// Dispatcher delivers the events of a bus to its Events channel, according to the overflow policy, and to its
+// subscribers, which never block it (see Hub). Dispatcher is meant for implementations of Bus.
+type Dispatcher struct {
+	q   *eventQueue
+	hub *Hub
+}
+
+// eventQueue delivers events to the Events channel according to the overflow policy
+type eventQueue struct {
+	ch     chan Event
+	policy Overflow
+	size   int
+	log    Logger
+	quit   chan struct{} // closed when the bus is closed, events are not waited for anymore
+	once   sync.Once
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []Event
+	lost    int    // number of events dropped since the last OverflowEvent
+	dropped uint64 // total number of dropped events
+	closed  bool
+}
+
+func newEventQueue(c *config) *eventQueue {
+	q := &eventQueue{policy: c.overflow, size: c.events, log: c.log, quit: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+
+	if q.policy == Block {
+		q.ch = make(chan Event, c.events)
+		return q
+	}
+
+	// the forwarder holds one more event
+	q.size--
+	if q.size < 1 {
+		q.size = 1
+	}
+
+	q.ch = make(chan Event)
+	go q.forward()
+
+	return q
+}
+
+// NewDispatcher creates a dispatcher. Only the WithEventCapacity, WithOverflow and WithLogger options are taken into
+// account, invalid ones are replaced by the defaults.
+func NewDispatcher(opts ...Option) *Dispatcher {
+	c := newConfig(opts)
+
+	if c.events < 1 {
+		c.events = EventCapacity
+	}
+
+	if c.overflow < Block || c.overflow > Coalesce {
+		c.overflow = Block
+	}
+
+	if c.log == nil {
+		c.log = NewLogger(nil, InfoLevel)
+	}
+
+	return newDispatcher(&c)
+}
+
+func newDispatcher(c *config) *Dispatcher {
+	return &Dispatcher{q: newEventQueue(c), hub: NewHub(c.events)}
+}
+
+// Emit delivers the event to the Events channel and subscribers.
+func (d *Dispatcher) Emit(ev Event) {
+	d.hub.Publish(ev)
+	d.q.push(ev)
+}
+
+// Events returns the Events channel.
+func (d *Dispatcher) Events() <-chan Event {
+	return d.q.ch
+}
+
+// Subscribe returns a channel of the events selected by all the filters, see Hub.Subscribe.
+func (d *Dispatcher) Subscribe(filters ...Filter) (<-chan Event, func()) {
+	return d.hub.Subscribe(filters...)
+}
+
+// Dropped returns the number of events dropped from the Events channel.
+func (d *Dispatcher) Dropped() uint64 {
+	return d.q.droppedEvents()
+}
+
+// Queued returns the number of events waiting for the consumer of the Events channel.
+func (d *Dispatcher) Queued() int {
+	return d.q.len()
+}
+
+// Close closes the subscriptions and the Events channel, the latter after all queued events are delivered.
+func (d *Dispatcher) Close() {
+	d.hub.Close()
+	d.q.close()
+}
+
+// Abort stops waiting for the consumer of the Events channel, so that a closed bus is not blocked by it.
+func (d *Dispatcher) Abort() {
+	d.q.abort()
+}
+
+// Queues the event, the Block policy waits for the consumer.
+func (q *eventQueue) push(ev Event) {
+	if q.policy == Block {
+		q.wait(ev)
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.queue) >= q.size {
+		switch q.policy {
+		case DropNewest:
+			q.drop()
+			return
+
+		case Coalesce:
+			i := len(q.queue) - 1
+			for i >= 0 && !coalescing(q.queue[i], ev) {
+				i--
+			}
+
+			if i < 0 {
+				i = 0
+			}
+			q.remove(i)
+
+		default:
+			q.remove(0)
+		}
+	}
+
+	q.queue = append(q.queue, ev)
+	q.cond.Signal()
+}
+
+// Waits until the consumer takes the event or the bus is closed, used by the Block policy.
+func (q *eventQueue) wait(ev Event) {
+	select {
+	case q.ch <- ev:
+		break
+
+	case <-q.quit:
+		break
+	}
+}
+
+// Returns the number of dropped events.
+func (q *eventQueue) droppedEvents() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dropped
+}
+
+// Returns the number of events waiting for the consumer.
+func (q *eventQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.queue) + len(q.ch)
+}
+
+// Closes the Events channel after all queued events are delivered.
+func (q *eventQueue) close() {
+	if q.policy == Block {
+		close(q.ch)
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Signal()
+}
+
+// Stops waiting for the consumer, so that a closed bus is not blocked by the Events channel.
+func (q *eventQueue) abort() {
+	q.once.Do(func() {
+		close(q.quit)
+	})
+}
+
+// drops the i-th queued event
+func (q *eventQueue) remove(i int) {
+	q.queue = append(q.queue[:i], q.queue[i+1:]...)
+	q.drop()
+}
+
+func (q *eventQueue) drop() {
+	if q.lost == 0 {
+		q.log.Log(WarnLevel, "event queue overflow", "policy", q.policy)
+	}
+
+	q.lost++
+	q.dropped++
+	q.cond.Signal()
+}
+
+// forwards queued events to the Events channel
+func (q *eventQueue) forward() {
+	for {
+		q.mu.Lock()
+		for len(q.queue) == 0 && q.lost == 0 && !q.closed {
+			q.cond.Wait()
+		}
+
+		var ev Event
+		switch {
+		case q.lost > 0:
+			ev = Event{Type: OverflowEvent, Dropped: q.lost}
+			q.lost = 0
+
+		case len(q.queue) > 0:
+			ev = q.queue[0]
+			q.queue = q.queue[1:]
+
+		default:
+			q.mu.Unlock()
+			close(q.ch)
+			return
+		}
+		q.mu.Unlock()
+
+		select {
+		case q.ch <- ev:
+			break
+
+		case <-q.quit:
+			close(q.ch)
+			return
+		}
+	}
+}
+
+// String returns the name of the overflow policy.
+func (o Overflow) String() string {
+	switch o {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Coalesce:
+		return "coalesce"
+	default:
+		return fmt.Sprintf("overflow(%d)", int(o))
+	}
+}
+
+// reports whether the new event can replace the queued one
+func coalescing(queued, ev Event) bool {
+	if queued.Type != ev.Type || queued.Err != ev.Err {
+		return false
+	}
+
+	if ev.Pkt != nil {
+		return queued.Pkt != nil && queued.Pkt.Addr == ev.Pkt.Addr
+	}
+
+	return queued.Addr == ev.Addr
+}
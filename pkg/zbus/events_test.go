@@ -0,0 +1,112 @@
+package zbus
+
+import (
+	"testing"
+	"time"
+)
+
+// TestOverflow tests the overflow policies of the Events channel.
+func TestOverflow(t *testing.T) {
+	pkt := func(addr Address, b byte) Event {
+		return Event{Type: PacketEvent, Pkt: &Packet{Addr: addr, Data: []byte{b}}}
+	}
+
+	for _, x := range []struct {
+		policy Overflow
+		exp    []byte // data of delivered packets after the overflow
+	}{
+		{DropOldest, []byte{3, 4}},
+		{DropNewest, []byte{2, 3}},
+		{Coalesce, []byte{3, 4}},
+	} {
+		c := newConfig([]Option{WithEventCapacity(3), WithOverflow(x.policy)})
+		q := newEventQueue(&c)
+
+		// let the forwarder take the 1st event
+		q.push(pkt(0x10, 1))
+		for i := 0; ; i++ {
+			q.mu.Lock()
+			n := len(q.queue)
+			q.mu.Unlock()
+
+			if n == 0 {
+				break
+			}
+
+			if i > 100 {
+				t.Fatalf("Event not forwarded")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		q.push(pkt(0x10, 2))
+		q.push(pkt(0x11, 3))
+		q.push(pkt(0x10, 4))
+
+		if q.droppedEvents() != 1 {
+			t.Errorf("Invalid number of dropped events (%v): %v", x.policy, q.droppedEvents())
+		}
+
+		if ev := <-q.ch; ev.Pkt.Data[0] != 1 {
+			t.Fatalf("Invalid 1st event (%v): %+v", x.policy, ev)
+		}
+
+		if ev := <-q.ch; ev.Type != OverflowEvent || ev.Dropped != 1 {
+			t.Fatalf("Overflow event expected (%v), got %+v", x.policy, ev)
+		}
+
+		for _, b := range x.exp {
+			if ev := <-q.ch; ev.Type != PacketEvent || ev.Pkt.Data[0] != b {
+				t.Fatalf("Invalid event (%v), packet %v expected, got %+v", x.policy, b, ev)
+			}
+		}
+
+		q.close()
+		if _, ok := <-q.ch; ok {
+			t.Errorf("Events channel not closed (%v)", x.policy)
+		}
+	}
+}
+
+// TestDispatcher tests that subscriptions do not affect the Block policy of the Events channel.
+func TestDispatcher(t *testing.T) {
+	d := NewDispatcher(WithEventCapacity(1))
+	sub, cancel := d.Subscribe()
+	defer cancel()
+
+	d.Emit(Event{Type: ConnectEvent, Addr: 0x10})
+
+	// the bus waits for the consumer, while the subscriber loses the event
+	done := make(chan struct{})
+	go func() {
+		d.Emit(Event{Type: ConnectEvent, Addr: 0x11})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Events channel did not block")
+	case <-time.After(20 * time.Millisecond):
+		break
+	}
+
+	for _, addr := range []Address{0x10, 0x11} {
+		if ev := <-d.Events(); ev.Type != ConnectEvent || ev.Addr != addr {
+			t.Fatalf("Invalid event %+v", ev)
+		}
+	}
+	<-done
+
+	if d.Dropped() != 0 {
+		t.Errorf("Events dropped: %v", d.Dropped())
+	}
+
+	if ev := <-sub; ev.Addr != 0x10 || len(sub) != 0 {
+		t.Errorf("Invalid subscribed event %+v", ev)
+	}
+
+	d.Close()
+	if _, ok := <-d.Events(); ok {
+		t.Errorf("Events channel not closed")
+	}
+}
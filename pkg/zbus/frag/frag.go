@@ -0,0 +1,289 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package frag implements segmentation and reassembly of messages larger than zbus.MaxPacketSize on top of a zbus.Bus.
+
+Every message is sent as a sequence of fragments. A fragment is a packet that starts with a two byte header: the
+sequence number of the message (incremented for every message sent to the same address) and the index of the
+fragment, which has the most significant bit set in the last fragment of the message. The rest of the packet holds
+the fragment data. Slaves must use the same format for both directions.
+*/
+package frag
+
+import (
+	"context"
+	"errors"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/wrap"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize   = 2    // size of the fragment header
+	lastFlag     = 0x80 // flags the last fragment of a message
+	maxFragments = 128  // maximum number of fragments of a message
+	chunkSize    = zbus.MaxPacketSize - headerSize
+
+	// MaxMessageSize is the maximum size of a message.
+	MaxMessageSize = maxFragments * chunkSize
+
+	// DefaultTimeout is the default time of waiting for the next fragment of a message.
+	DefaultTimeout = 5 * time.Second
+)
+
+var (
+	// ErrIncomplete is the cause of a BusError event reporting a message that could not be reassembled because some
+	// of its fragments are missing.
+	ErrIncomplete = errors.New("incomplete message")
+
+	// ErrTooLarge is returned when sending a message larger than MaxMessageSize.
+	ErrTooLarge = errors.New("message too large")
+)
+
+// Bus is a zbus.Bus that transparently splits outgoing messages into fragments and reassembles incoming ones.
+// Incoming messages are reported by PacketEvents, all other events of the underlying bus are passed through. Incomplete
+// messages are dropped when the bus is reset.
+type Bus struct {
+	base
+	bus     zbus.Bus
+	loop    *wrap.Loop
+	timeout time.Duration
+	events  []zbus.Option // options of the event dispatcher
+
+	mu  sync.Mutex
+	seq map[zbus.Address]uint8 // next sequence numbers of outgoing messages
+
+	msgs map[zbus.Address]*message // incoming messages being reassembled
+}
+
+// base passes the methods of zbus.Bus that need no fragmentation through to the underlying bus
+type base = wrap.Base
+
+// Option configures a Bus.
+type Option func(*Bus)
+
+type message struct {
+	seq      uint8
+	next     int // index of the next fragment
+	data     []byte
+	deadline time.Time
+}
+
+// WithTimeout sets the time of waiting for the next fragment of a message. An incomplete message is dropped and
+// reported when the timeout expires. The default timeout is DefaultTimeout, non-positive timeouts are ignored.
+func WithTimeout(d time.Duration) Option {
+	return func(f *Bus) {
+		if d > 0 {
+			f.timeout = d
+		}
+	}
+}
+
+// WithEvents configures the Events channel and subscriptions of the bus by the zbus.WithEventCapacity,
+// zbus.WithOverflow and zbus.WithLogger options, other options are ignored. The defaults are those of zbus, not the
+// configuration of the underlying bus, so the options it was created with are usually passed here as well.
+func WithEvents(opts ...zbus.Option) Option {
+	return func(f *Bus) {
+		f.events = append(f.events, opts...)
+	}
+}
+
+// New creates a fragmenting bus on top of the given bus. The returned bus takes over the events of the underlying
+// one, which must not be used directly anymore.
+func New(b zbus.Bus, opts ...Option) *Bus {
+	f := &Bus{
+		bus:     b,
+		timeout: DefaultTimeout,
+		seq:     make(map[zbus.Address]uint8),
+		msgs:    make(map[zbus.Address]*message),
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	f.base, f.loop = wrap.New(b, f.events...)
+
+	go f.processEvents()
+
+	return f
+}
+
+// Send sends a message of up to MaxMessageSize bytes. Failures are reported by error events.
+func (f *Bus) Send(pkt zbus.Packet) {
+	frags, err := f.split(pkt)
+	if err != nil {
+		f.loop.Report((&zbus.Error{Type: zbus.AckError, Addr: pkt.Addr, Err: err}).Event())
+		return
+	}
+
+	for _, frag := range frags {
+		f.bus.Send(frag)
+	}
+}
+
+// SendSync sends a message of up to MaxMessageSize bytes and waits until all its fragments are delivered. Delivery
+// stops at the first failed fragment.
+func (f *Bus) SendSync(ctx context.Context, pkt zbus.Packet) error {
+	frags, err := f.split(pkt)
+	if err != nil {
+		return err
+	}
+
+	for _, frag := range frags {
+		if err := f.bus.SendSync(ctx, frag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splits the message into fragments
+func (f *Bus) split(pkt zbus.Packet) ([]zbus.Packet, error) {
+	n := (len(pkt.Data) + chunkSize - 1) / chunkSize
+	if n == 0 {
+		n = 1
+	}
+
+	if n > maxFragments {
+		return nil, ErrTooLarge
+	}
+
+	f.mu.Lock()
+	seq := f.seq[pkt.Addr]
+	f.seq[pkt.Addr] = seq + 1
+	f.mu.Unlock()
+
+	frags := make([]zbus.Packet, n)
+	for i := range frags {
+		chunk := pkt.Data[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		data := make([]byte, headerSize, headerSize+len(chunk))
+		data[0] = seq
+		data[1] = uint8(i)
+		if i == n-1 {
+			data[1] |= lastFlag
+		}
+
+		frags[i] = zbus.Packet{Addr: pkt.Addr, Data: append(data, chunk...)}
+	}
+
+	return frags, nil
+}
+
+func (f *Bus) processEvents() {
+	ticker := time.NewTicker(f.timeout / 4)
+
+	defer func() {
+		ticker.Stop()
+		f.loop.Close()
+	}()
+
+	for {
+		select {
+		case ev, ok := <-f.bus.Events():
+			if !ok {
+				return
+			}
+
+			f.process(ev)
+
+		case <-f.loop.Posted():
+			f.loop.Run()
+
+		case now := <-ticker.C:
+			// drop messages waiting for a fragment for too long
+			for addr, m := range f.msgs {
+				if now.After(m.deadline) {
+					f.drop(addr)
+				}
+			}
+		}
+	}
+}
+
+func (f *Bus) process(ev zbus.Event) {
+	switch ev.Type {
+	case zbus.PacketEvent:
+		f.reassemble(ev.Pkt)
+		return
+
+	case zbus.ResetEvent:
+		for addr := range f.msgs {
+			f.drop(addr)
+		}
+
+	case zbus.DisconnectEvent, zbus.ReregisterEvent:
+		f.drop(ev.Addr)
+	}
+
+	f.loop.Emit(ev)
+}
+
+func (f *Bus) reassemble(pkt *zbus.Packet) {
+	if len(pkt.Data) < headerSize {
+		f.loop.Emit(errorEvent(pkt.Addr, errors.New("invalid fragment header")))
+		return
+	}
+
+	seq := pkt.Data[0]
+	idx := int(pkt.Data[1] &^ lastFlag)
+	last := pkt.Data[1]&lastFlag != 0
+
+	m := f.msgs[pkt.Addr]
+	if idx == 0 {
+		// a new message, drop the previous one if incomplete
+		f.drop(pkt.Addr)
+
+		m = &message{seq: seq}
+		f.msgs[pkt.Addr] = m
+	} else if m == nil || m.seq != seq || m.next != idx {
+		// missing fragments
+		if !f.drop(pkt.Addr) {
+			f.loop.Emit(errorEvent(pkt.Addr, ErrIncomplete))
+		}
+		return
+	}
+
+	m.data = append(m.data, pkt.Data[headerSize:]...)
+	m.next++
+	m.deadline = time.Now().Add(f.timeout)
+
+	if last {
+		delete(f.msgs, pkt.Addr)
+		f.loop.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &zbus.Packet{Addr: pkt.Addr, Data: m.data}})
+	}
+}
+
+// drops the incomplete message from the address and reports it
+func (f *Bus) drop(addr zbus.Address) bool {
+	if _, ok := f.msgs[addr]; !ok {
+		return false
+	}
+
+	delete(f.msgs, addr)
+	f.loop.Emit(errorEvent(addr, ErrIncomplete))
+
+	return true
+}
+
+func errorEvent(addr zbus.Address, cause error) zbus.Event {
+	return (&zbus.Error{Type: zbus.BusError, Addr: addr, Err: cause}).Event()
+}
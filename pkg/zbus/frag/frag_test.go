@@ -0,0 +1,130 @@
+package frag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/bustest"
+	"testing"
+	"time"
+)
+
+// TestFragmentation tests splitting and reassembly of messages.
+func TestFragmentation(t *testing.T) {
+	b := bustest.New()
+	f := New(b)
+	defer f.Close()
+
+	for _, n := range []int{0, 1, chunkSize, chunkSize + 1, 5000, MaxMessageSize} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		if err := f.SendSync(context.Background(), zbus.Packet{Addr: 0x10, Data: data}); err != nil {
+			t.Fatalf("SendSync failed: %v", err)
+		}
+
+		for _, pkt := range b.Loop() {
+			if len(pkt.Data) > zbus.MaxPacketSize {
+				t.Fatalf("Fragment too large: %v", len(pkt.Data))
+			}
+		}
+
+		ev := bustest.NextEvent(t, f)
+		if ev.Type != zbus.PacketEvent || ev.Pkt.Addr != 0x10 || !bytes.Equal(ev.Pkt.Data, data) {
+			t.Fatalf("Invalid packet event of %v bytes: %+v", n, ev)
+		}
+	}
+
+	if err := f.SendSync(context.Background(), zbus.Packet{Data: make([]byte, MaxMessageSize+1)}); err != ErrTooLarge {
+		t.Errorf("ErrTooLarge expected, got %v", err)
+	}
+}
+
+// TestIncomplete tests that messages with missing fragments are reported.
+func TestIncomplete(t *testing.T) {
+	b := bustest.New()
+	f := New(b, WithTimeout(20*time.Millisecond))
+	defer f.Close()
+
+	incomplete := func() {
+		t.Helper()
+
+		ev := bustest.NextEvent(t, f)
+		if ev.Type != zbus.ErrorEvent || ev.Err != zbus.BusError || !errors.Is(ev.Cause, ErrIncomplete) {
+			t.Fatalf("Incomplete message error expected, got %+v", ev)
+		}
+	}
+
+	f.Send(zbus.Packet{Addr: 0x10, Data: make([]byte, 3*chunkSize)})
+	frags := b.Take()
+
+	// a fragment is missing
+	b.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &frags[0]})
+	b.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &frags[2]})
+	incomplete()
+
+	// the last fragment never arrives
+	b.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &frags[0]})
+	b.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &frags[1]})
+	incomplete()
+
+	// the slave disconnects
+	b.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &frags[0]})
+	b.Emit(zbus.Event{Type: zbus.DisconnectEvent, Addr: 0x10})
+	incomplete()
+
+	if ev := bustest.NextEvent(t, f); ev.Type != zbus.DisconnectEvent {
+		t.Fatalf("Disconnect event expected, got %+v", ev)
+	}
+}
+
+// TestBlockedLoop tests that failures are reported without blocking the sender while the event loop waits for the
+// consumer of the Events channel.
+func TestBlockedLoop(t *testing.T) {
+	b := bustest.New()
+	f := New(b)
+	defer f.Close()
+
+	// the last event blocks the loop
+	for i := 0; i <= zbus.EventCapacity; i++ {
+		b.Emit(zbus.Event{Type: zbus.DisconnectEvent, Addr: 0x10})
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		f.Send(zbus.Packet{Addr: 0x10, Data: make([]byte, MaxMessageSize+1)})
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		break
+	case <-time.After(time.Second):
+		t.Fatalf("Send blocked")
+	}
+
+	// the failure is reported among the pending events
+	for i := 0; i <= zbus.EventCapacity+1; i++ {
+		if ev := bustest.NextEvent(t, f); ev.Type == zbus.ErrorEvent {
+			if !errors.Is(ev.Cause, ErrTooLarge) {
+				t.Fatalf("Too large message error expected, got %+v", ev)
+			}
+			return
+		}
+	}
+
+	t.Fatalf("Failure not reported")
+}
+
+// TestEvents tests that the options of events are applied.
+func TestEvents(t *testing.T) {
+	f := New(bustest.New(), WithEvents(zbus.WithEventCapacity(2*zbus.EventCapacity)))
+	defer f.Close()
+
+	if n := cap(f.Events()); n != 2*zbus.EventCapacity {
+		t.Errorf("Invalid event capacity %v", n)
+	}
+}
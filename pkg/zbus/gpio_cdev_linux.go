@@ -0,0 +1,161 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	gpioV2LinesMax       = 64
+	gpioMaxNameSize      = 32
+	gpioV2LineNumAttrMax = 10
+
+	gpioV2LineFlagInput       = 1 << 2
+	gpioV2LineFlagEdgeRising  = 1 << 4
+	gpioV2LineFlagEdgeFalling = 1 << 5
+
+	gpioV2LineEventRisingEdge  = 1
+	gpioV2LineEventFallingEdge = 2
+
+	gpioV2LineEventSize = 48 // size of struct gpio_v2_line_event
+)
+
+// represents struct gpio_v2_line_config_attribute from <linux/gpio.h>
+type gpioV2LineConfigAttribute struct {
+	id    uint32
+	_     uint32
+	value uint64
+	mask  uint64
+}
+
+// represents struct gpio_v2_line_config from <linux/gpio.h>
+type gpioV2LineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	_        [5]uint32
+	attrs    [gpioV2LineNumAttrMax]gpioV2LineConfigAttribute
+}
+
+// represents struct gpio_v2_line_request from <linux/gpio.h>
+type gpioV2LineRequest struct {
+	offsets         [gpioV2LinesMax]uint32
+	consumer        [gpioMaxNameSize]byte
+	config          gpioV2LineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	_               [5]uint32
+	fd              int32
+}
+
+// represents struct gpio_v2_line_values from <linux/gpio.h>
+type gpioV2LineValues struct {
+	bits uint64
+	mask uint64
+}
+
+// Requests the line of the GPIO character device as an input with edge detection on both edges.
+func newGpioLine(chip int, line int) (*gpio, error) {
+	path := fmt.Sprintf("/dev/gpiochip%v", chip)
+	cfd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", path, err)
+	}
+	defer func() { _ = syscall.Close(cfd) }()
+
+	req := gpioV2LineRequest{numLines: 1}
+	req.offsets[0] = uint32(line)
+	req.config.flags = gpioV2LineFlagInput | gpioV2LineFlagEdgeRising | gpioV2LineFlagEdgeFalling
+	copy(req.consumer[:], "zbus-alert")
+
+	getLine := iowr(0xB4, 0x07, unsafe.Sizeof(req))
+	if err := ioctl(cfd, getLine, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("request %s line %v: %v", path, line, err)
+	}
+
+	// edge events are read without blocking to allow the watcher to be interrupted
+	if err := syscall.SetNonblock(int(req.fd), true); err != nil {
+		_ = syscall.Close(int(req.fd))
+		return nil, err
+	}
+
+	a := &gpio{state: make(chan int), fd: int(req.fd), done: make(chan struct{}, 1)}
+
+	// report the initial state first, then follow edge events
+	a.next = func() (int, error) {
+		a.next = a.readEvent
+		return a.lineValue()
+	}
+
+	return a, nil
+}
+
+// Reads the current value of the requested line.
+func (a *gpio) lineValue() (int, error) {
+	vals := gpioV2LineValues{mask: 1}
+
+	getValues := iowr(0xB4, 0x0E, unsafe.Sizeof(vals))
+	if err := ioctl(a.fd, getValues, unsafe.Pointer(&vals)); err != nil {
+		return 0, err
+	}
+
+	return int(vals.bits & 1), nil
+}
+
+// Waits for an edge event of the requested line. Returns -1 if the wait was interrupted.
+func (a *gpio) readEvent() (int, error) {
+	if err := poll(a.fd, false); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, gpioV2LineEventSize)
+	n, err := syscall.Read(a.fd, buf)
+	if err == syscall.EAGAIN {
+		return -1, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if n != len(buf) {
+		return 0, fmt.Errorf("short GPIO event read (%v bytes)", n)
+	}
+
+	// the id field follows the 64-bit timestamp
+	switch *(*uint32)(unsafe.Pointer(&buf[8])) {
+	case gpioV2LineEventRisingEdge:
+		return 1, nil
+
+	case gpioV2LineEventFallingEdge:
+		return 0, nil
+	}
+
+	return -1, nil
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func iowr(typ, nr, size uintptr) uintptr {
+	return (iocRead|iocWrite)<<iocDirShift | size<<iocSizeShift | typ<<iocTypeShift | nr
+}
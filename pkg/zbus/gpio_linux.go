@@ -15,18 +15,35 @@
 package zbus
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"syscall"
+	"time"
 )
 
+// interval of polling the alert signal of an AlertTransport
+const alertPoll = time.Millisecond
+
 type gpio struct {
 	state chan int // alert state
 	err   error    // alert error (might be set when the state channel is closed)
 
-	fd   int
+	fd   int // -1 if the alert signal is not read from a file
 	done chan struct{}
+
+	// waits for a signal edge and returns the new state
+	next func() (int, error)
+}
+
+// Opens the alert pin using either the GPIO character device or the sysfs interface.
+func openGpio(pin AlertPin) (*gpio, error) {
+	if pin.Sysfs {
+		return newGpio(pin.Line)
+	}
+
+	return newGpioLine(pin.Chip, pin.Line)
 }
 
 // Configures the alert pin by writing "in" to "direction" and "both" to "edge". Then opens the "value" file.
@@ -46,24 +63,69 @@ func newGpio(pin int) (*gpio, error) {
 		return nil, err
 	}
 
-	// size of the done channel must be one to prevent deadlock between syscall.Select and selecting the done channel
-	return &gpio{make(chan int), nil, fd, make(chan struct{}, 1)}, nil
+	a := &gpio{state: make(chan int), fd: fd, done: make(chan struct{}, 1)}
+	a.next = a.readValue
+
+	return a, nil
+}
+
+// Follows the alert signal of the transport by polling it.
+func newTransportAlert(tr AlertTransport) *gpio {
+	a := &gpio{state: make(chan int), fd: -1, done: make(chan struct{}, 1)}
+
+	last := -1
+	a.next = func() (int, error) {
+		select {
+		case <-a.done:
+			return -1, nil
+		case <-time.After(alertPoll):
+			break
+		}
+
+		// the signal is active low
+		s := 1
+		if tr.Alert() {
+			s = 0
+		}
+
+		if s == last {
+			return -1, nil
+		}
+
+		last = s
+		return s, nil
+	}
+
+	return a
+}
+
+// Returns the reason why the state channel was closed.
+func (a *gpio) cause() error {
+	if a.err != nil {
+		return fmt.Errorf("alert pin: %v", a.err)
+	}
+
+	return errors.New("alert pin closed")
 }
 
 func (a *gpio) close() {
 	close(a.done)
-	_ = syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+
+	if a.fd >= 0 {
+		// interrupt the blocking system call
+		_ = syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	}
 }
 
 // Listens for alert signal edges.
 func (a *gpio) watch() {
 	defer func() {
-		_ = syscall.Close(a.fd)
+		if a.fd >= 0 {
+			_ = syscall.Close(a.fd)
+		}
 		close(a.state)
 	}()
 
-	buf := make([]byte, 16)
-
 	for {
 		select {
 		case <-a.done:
@@ -73,35 +135,60 @@ func (a *gpio) watch() {
 			break
 		}
 
-		if err := poll(a.fd); err != nil {
+		s, err := a.next()
+		if err != nil {
 			a.err = err
 			return
 		}
 
-		_, err := syscall.Seek(a.fd, 0, io.SeekStart)
-		if err != nil {
-			a.err = err
-			return
+		if s < 0 {
+			continue
 		}
 
-		n, err := syscall.Read(a.fd, buf)
-		if err != nil {
-			a.err = err
+		select {
+		case a.state <- s:
+			break
+		case <-a.done:
 			return
 		}
+	}
+}
 
-		if "0\n" == string(buf[:n]) {
-			a.state <- 0
-		} else {
-			a.state <- 1
-		}
+// Waits for an edge and reads the sysfs "value" file.
+func (a *gpio) readValue() (int, error) {
+	if err := poll(a.fd, true); err != nil {
+		return 0, err
+	}
+
+	_, err := syscall.Seek(a.fd, 0, io.SeekStart)
+	if err != nil {
+		return 0, err
 	}
+
+	buf := make([]byte, 16)
+	n, err := syscall.Read(a.fd, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	if "0\n" == string(buf[:n]) {
+		return 0, nil
+	}
+
+	return 1, nil
 }
 
-func poll(fd int) error {
+// Waits until the file descriptor becomes readable, or until an exceptional condition occurs if except is set.
+func poll(fd int, except bool) error {
 	fds := &syscall.FdSet{}
 	fds.Bits[fd/64] |= 1 << (uint(fd) % 64)
-	_, err := syscall.Select(fd+1, nil, nil, fds, nil)
+
+	var err error
+	if except {
+		_, err = syscall.Select(fd+1, nil, nil, fds, nil)
+	} else {
+		_, err = syscall.Select(fd+1, fds, nil, nil, nil)
+	}
 
 	if err == syscall.EINTR {
 		return nil
@@ -0,0 +1,150 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import "sync"
+
+// Filter selects the events delivered to a subscriber.
+type Filter func(ev Event) bool
+
+// Hub distributes events to subscribers, each subscriber gets its own buffered channel. Publishing never blocks: a
+// subscriber that does not keep up loses the events that do not fit into its channel. The lost events are counted for
+// every subscriber and reported by an OverflowEvent delivered before the next event that fits. Hub is meant for
+// implementations of Bus.
+type Hub struct {
+	mu       sync.Mutex
+	subs     map[*subscriber]struct{}
+	capacity int
+	closed   bool
+}
+
+type subscriber struct {
+	ch      chan Event
+	filters []Filter
+	lost    int // number of events dropped since the last OverflowEvent
+}
+
+// EventTypes selects events of the given types.
+func EventTypes(types ...eventType) Filter {
+	return func(ev Event) bool {
+		for _, t := range types {
+			if ev.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Addrs selects events related to slaves with the given addresses, including packets received from them.
+func Addrs(addrs ...Address) Filter {
+	return func(ev Event) bool {
+		addr := ev.Addr
+		if ev.Pkt != nil {
+			addr = ev.Pkt.Addr
+		}
+
+		for _, a := range addrs {
+			if addr == a {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NewHub creates a hub that creates subscriber channels of the given capacity.
+func NewHub(capacity int) *Hub {
+	return &Hub{subs: make(map[*subscriber]struct{}), capacity: capacity}
+}
+
+// Subscribe returns a channel that delivers the events selected by all the filters (all events if there are none)
+// and a function that cancels the subscription and closes the channel. The channel is closed when the hub is closed.
+func (h *Hub) Subscribe(filters ...Filter) (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &subscriber{ch: make(chan Event, h.capacity), filters: filters}
+	if h.closed {
+		close(s.ch)
+		return s.ch, func() {}
+	}
+
+	h.subs[s] = struct{}{}
+
+	return s.ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if _, ok := h.subs[s]; ok {
+			delete(h.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+// Publish delivers the event to all subscribers that select it.
+func (h *Hub) Publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs {
+		if s.match(ev) {
+			s.deliver(ev)
+		}
+	}
+}
+
+// Close closes the channels of all subscribers.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs {
+		close(s.ch)
+	}
+
+	h.subs = nil
+	h.closed = true
+}
+
+// delivers the event unless the subscriber is too slow, the lost events are reported first
+func (s *subscriber) deliver(ev Event) {
+	if s.lost > 0 {
+		select {
+		case s.ch <- Event{Type: OverflowEvent, Dropped: s.lost}:
+			s.lost = 0
+		default:
+			s.lost++
+			return
+		}
+	}
+
+	select {
+	case s.ch <- ev:
+		break
+	default:
+		s.lost++
+	}
+}
+
+func (s *subscriber) match(ev Event) bool {
+	for _, f := range s.filters {
+		if !f(ev) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package zbus
+
+import "testing"
+
+// TestHub tests distribution of events to subscribers.
+func TestHub(t *testing.T) {
+	h := NewHub(2)
+
+	all, cancelAll := h.Subscribe()
+	pkts, _ := h.Subscribe(EventTypes(PacketEvent), Addrs(0x10))
+
+	h.Publish(Event{Type: PacketEvent, Pkt: &Packet{Addr: 0x10}})
+	h.Publish(Event{Type: PacketEvent, Pkt: &Packet{Addr: 0x11}})
+	h.Publish(Event{Type: ConnectEvent, Addr: 0x10})
+
+	// the slow subscriber lost the last event
+	if len(all) != 2 {
+		t.Errorf("Invalid number of events, 2 expected, got %v", len(all))
+	}
+
+	if len(pkts) != 1 {
+		t.Fatalf("Invalid number of filtered events, 1 expected, got %v", len(pkts))
+	}
+
+	if ev := <-pkts; ev.Type != PacketEvent || ev.Pkt.Addr != 0x10 {
+		t.Errorf("Invalid filtered event %+v", ev)
+	}
+
+	cancelAll()
+	cancelAll()
+
+	<-all
+	<-all
+	if _, ok := <-all; ok {
+		t.Errorf("Cancelled subscription not closed")
+	}
+
+	h.Close()
+	if _, ok := <-pkts; ok {
+		t.Errorf("Subscription not closed")
+	}
+
+	if ch, _ := h.Subscribe(); ch == nil {
+		t.Errorf("No channel returned")
+	} else if _, ok := <-ch; ok {
+		t.Errorf("Subscription of a closed hub not closed")
+	}
+}
+
+// TestHubOverflow tests that the events lost by a slow subscriber are reported.
+func TestHubOverflow(t *testing.T) {
+	h := NewHub(2)
+	defer h.Close()
+
+	ch, _ := h.Subscribe()
+	for i := 0; i < 4; i++ {
+		h.Publish(Event{Type: ConnectEvent, Addr: Address(0x10 + i)})
+	}
+
+	<-ch
+	<-ch
+
+	// the overflow is reported before the next event
+	h.Publish(Event{Type: ConnectEvent, Addr: 0x14})
+	if ev := <-ch; ev.Type != OverflowEvent || ev.Dropped != 2 {
+		t.Fatalf("Overflow event expected, got %+v", ev)
+	}
+
+	if ev := <-ch; ev.Type != ConnectEvent || ev.Addr != 0x14 {
+		t.Fatalf("Invalid event %+v", ev)
+	}
+}
@@ -15,8 +15,12 @@
 package zbus
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -24,15 +28,45 @@ import (
 
 // I2CBus implements the Bus interface using I2C and GPIO.
 type I2CBus struct {
-	ev chan Event
+	ev *Dispatcher
 
 	ticker *time.Ticker
 	work   chan func() error
+	stop   chan struct{}
 	done   chan struct{}
+	term   chan struct{}
 	arp    arp
 
-	i2c   int
-	alert *gpio
+	stopOnce sync.Once
+	doneOnce sync.Once
+
+	retries     []retry               // scheduled retries ordered by time
+	backlog     map[*slave][]outgoing // packets waiting for a retry of the previous packet to the same slave
+	reading     bool                  // the read of a polled packet waits for a retry
+	configuring bool                  // the configuration of a discovered slave waits for a retry
+
+	tr        Transport
+	alert     *gpio
+	cfg       config
+	stats     *counters
+	noZeroLen bool // the transport does not support zero-length transactions
+}
+
+// a transaction scheduled to be retried
+type retry struct {
+	at time.Time
+	fn func(abandoned error) error // abandoned is the reason why the retry is not performed, nil to perform it
+}
+
+// a packet waiting to be sent
+type outgoing struct {
+	pkt  Packet
+	done func(error)
+}
+
+// i2cDev implements the Transport interface using the Linux userspace I2C interface.
+type i2cDev struct {
+	fd int
 }
 
 // represents struct i2c_msg from <linux/i2c-dev.h>
@@ -51,115 +85,281 @@ type i2cRdwrIoctlData struct {
 }
 
 // NewI2CBus creates a new I2C and GPIO based Bus instance.
-func NewI2CBus(dev int, pin int) (*I2CBus, error) {
+func NewI2CBus(dev int, pin AlertPin, opts ...Option) (*I2CBus, error) {
 	// check parameters
 	if dev < 0 || dev > MaxI2C {
 		return nil, errors.New("invalid I2C device index")
 	}
 
-	if pin < 0 || pin > MaxPin {
-		return nil, errors.New("invalid GPIO pin index")
-	}
-
 	// open I2C device
 	i2cPath := fmt.Sprintf("/dev/i2c-%v", dev)
-	i2c, err := syscall.Open(i2cPath, syscall.O_RDWR, 0)
+	fd, err := syscall.Open(i2cPath, syscall.O_RDWR, 0)
 	if err != nil {
 		return nil, fmt.Errorf("open %s: %v", i2cPath, err)
 	}
 
-	// open GPIO alert pin
-	alert, err := newGpio(pin)
+	b, err := NewI2CBusTransport(&i2cDev{fd}, &pin, opts...)
 	if err != nil {
+		_ = syscall.Close(fd)
 		return nil, err
 	}
 
-	b := &I2CBus{
-		ev: make(chan Event, EventCapacity),
+	return b, nil
+}
 
-		ticker: time.NewTicker(time.Second),
-		work:   make(chan func() error),
-		done:   make(chan struct{}),
+// NewI2CBusTransport creates a new Bus instance that performs I2C transactions using the given transport and uses
+// the GPIO pin as the alert signal. Without a pin, the alert signal is taken from the transport, which must be an
+// AlertTransport then, e.g. a MemTransport. The transport is closed together with the bus.
+func NewI2CBusTransport(tr Transport, pin *AlertPin, opts ...Option) (*I2CBus, error) {
+	at, ok := tr.(AlertTransport)
+	if pin == nil && !ok {
+		return nil, errors.New("missing alert pin")
+	}
 
-		i2c:   i2c,
-		alert: alert,
+	if pin != nil {
+		if err := pin.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := newConfig(opts)
+	if err := cfg.setup(); err != nil {
+		return nil, err
+	}
+
+	var alert *gpio
+	if pin != nil {
+		// open GPIO alert pin
+		var err error
+		if alert, err = openGpio(*pin); err != nil {
+			return nil, err
+		}
+	} else {
+		alert = newTransportAlert(at)
 	}
 
+	b := newI2CBus(tr, alert, cfg)
+
+	go b.alert.watch()
+	go b.processWork()
 	b.Reset()
 
 	return b, nil
 }
 
+func newI2CBus(tr Transport, alert *gpio, cfg config) *I2CBus {
+	return &I2CBus{
+		ev: newDispatcher(&cfg),
+
+		ticker: time.NewTicker(cfg.discovery),
+		work:   make(chan func() error),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		term:   make(chan struct{}),
+
+		backlog: make(map[*slave][]outgoing),
+
+		tr:    tr,
+		alert: alert,
+		arp:   newArp(&cfg),
+		cfg:   cfg,
+		stats: newCounters(),
+	}
+}
+
 // Close closes the I2C bus.
 func (b *I2CBus) Close() {
-	close(b.done)
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+
+	b.quit()
+	b.ev.Abort()
 }
 
-// Reset resets the I2C bus by sending the reset command.
-func (b *I2CBus) Reset() {
-	b.work <- func() error {
-		_, err := b.transfer(CallAddr, false, []byte{0})
-		if err != nil {
+// Shutdown closes the I2C bus gracefully. The slaves are notified by the quit command sent to the general call
+// address.
+func (b *I2CBus) Shutdown(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+
+	err := invoke(ctx, b.work, b.term, func(done func(error)) error {
+		b.cfg.log.Log(InfoLevel, "shutting down bus")
+
+		if err := drain(b.work); err != nil {
 			return err
 		}
 
-		b.arp = arp{}
+		if err := b.flush(); err != nil {
+			return err
+		}
 
-		b.ev <- Event{Type: ResetEvent}
+		// let the slaves know that the master leaves
+		if _, err := b.transfer(CallAddr, false, []byte{callQuit}); err != nil {
+			return err
+		}
 
+		b.quit()
+		done(nil)
 		return nil
+	})
+
+	return awaitShutdown(ctx, b.term, err)
+}
+
+// Reset resets the I2C bus by sending the reset command. Packets waiting for a retry fail with ErrBus.
+func (b *I2CBus) Reset() {
+	ok := submit(b.work, b.stop, b.term, b.reset)
+
+	if !ok {
+		b.cfg.log.Log(WarnLevel, "bus closed, reset ignored")
 	}
 }
 
-// Send sends a packet to the I2C bus.
-func (b *I2CBus) Send(pkt Packet) {
-	b.work <- func() error {
-		s := b.arp.slave(pkt.Addr)
-		if s == nil {
-			b.ev <- Event{Type: ErrorEvent, Err: AckError, Addr: pkt.Addr}
+// Resets the bus in the work loop. The scheduled retries are abandoned, so that none of them addresses a slave that is
+// assigned another address after the reset.
+func (b *I2CBus) reset() error {
+	_, err := b.transfer(CallAddr, false, []byte{callReset})
+	if err != nil {
+		return err
+	}
+
+	// the packets waiting for a retry of the previous packet fail first, so that the abandoned retry does not send them
+	backlog := b.backlog
+	b.backlog = make(map[*slave][]outgoing)
+
+	for _, q := range backlog {
+		for _, o := range q {
+			o.done(ErrBus)
 		}
+	}
 
-		ok, err := b.transfer(pkt.Addr, false, pkt.Data)
-		if err != nil {
+	retries := b.retries
+	b.retries = nil
+
+	for _, r := range retries {
+		if err := r.fn(ErrBus); err != nil {
 			return err
 		}
+	}
 
-		if ok {
-			s.touch()
-		} else {
-			// TODO(mbenda): backoff/retry?
-			b.ev <- Event{Type: ErrorEvent, Err: AckError, Addr: pkt.Addr}
-		}
+	b.reading = false
+	b.configuring = false
+	b.arp.reset()
 
-		return nil
+	b.cfg.log.Log(InfoLevel, "bus reset")
+	b.emit(Event{Type: ResetEvent})
+
+	return nil
+}
+
+// Send sends a packet to the I2C bus.
+func (b *I2CBus) Send(pkt Packet) {
+	ok := submit(b.work, b.stop, b.term, func() error {
+		return b.send(pkt, func(err error) {
+			if err != nil {
+				b.emit(errorEvent(AckError, pkt.Addr, err))
+			}
+		})
+	})
+
+	if !ok {
+		b.cfg.log.Log(WarnLevel, "bus closed, packet dropped", "addr", addrString(pkt.Addr), "len", len(pkt.Data))
 	}
 }
 
+// SendSync sends a packet to the I2C bus and waits until it is acknowledged by the slave.
+func (b *I2CBus) SendSync(ctx context.Context, pkt Packet) error {
+	if stopped(b.stop) {
+		return ErrClosed
+	}
+
+	return invoke(ctx, b.work, b.term, func(done func(error)) error {
+		return b.send(pkt, done)
+	})
+}
+
 // Events provides access to the channel of bus events.
 func (b *I2CBus) Events() <-chan Event {
-	return b.ev
+	return b.ev.Events()
+}
+
+// DroppedEvents returns the number of events dropped according to the overflow policy.
+func (b *I2CBus) DroppedEvents() uint64 {
+	return b.ev.Dropped()
+}
+
+// Stats returns the statistics of the bus.
+func (b *I2CBus) Stats() Stats {
+	return b.stats.stats(b.ev)
+}
+
+// Devices returns information about all registered slaves.
+func (b *I2CBus) Devices() []DeviceInfo {
+	return devices(b.term, &b.arp)
+}
+
+// Device returns information about the slave with the given address.
+func (b *I2CBus) Device(addr Address) (DeviceInfo, bool) {
+	return device(b.term, &b.arp, addr)
+}
+
+// Subscribe returns a channel of the selected bus events.
+func (b *I2CBus) Subscribe(filters ...Filter) (<-chan Event, func()) {
+	return b.ev.Subscribe(filters...)
+}
+
+// Terminates the work loop.
+func (b *I2CBus) quit() {
+	b.doneOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+func (b *I2CBus) emit(ev Event) {
+	b.stats.count(ev, &b.arp)
+	logEvent(b.cfg.log, ev)
+	b.ev.Emit(ev)
 }
 
 func (b *I2CBus) processWork() {
 	defer func() {
 		b.ticker.Stop()
 		b.alert.close()
-		_ = syscall.Close(b.i2c)
-		close(b.ev)
+		_ = b.tr.Close()
+		b.ev.Close()
+		close(b.term)
 	}()
 
 	var alert bool
 
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
 	for {
+		// wake up when the first scheduled retry is due
+		var due <-chan time.Time
+		if len(b.retries) > 0 {
+			timer.Reset(time.Until(b.retries[0].at))
+			due = timer.C
+		}
+
 		// wait for next event
 		select {
 		case <-b.done:
 			// we are done here
 			return
 
+		case now := <-due:
+			if err := b.retry(now); err != nil {
+				b.emit(errorEvent(SysError, 0, err))
+				return
+			}
+
 		case <-b.ticker.C:
 			if err := b.discover(); err != nil {
-				b.ev <- Event{Type: ErrorEvent, Err: SysError} // TODO err
+				b.emit(errorEvent(SysError, 0, err))
 				return
 			}
 
@@ -167,39 +367,51 @@ func (b *I2CBus) processWork() {
 			// do some work
 			if err := fn(); err != nil {
 				// terminate with the error
-				b.ev <- Event{Type: ErrorEvent, Err: SysError} // TODO err
+				b.emit(errorEvent(SysError, 0, err))
 				return
 			}
 
 		case s, ok := <-b.alert.state:
 			// TODO(mbenda): higher priority
 			if !ok {
-				b.ev <- Event{Type: ErrorEvent, Err: SysError} // TODO b.alert.err
+				b.emit(errorEvent(SysError, 0, b.alert.cause()))
 				return
 			}
 			alert = s == 0
 		}
 
-		// process alert, not more than MaxSlaves in a row
-		limit := MaxSlaves
+		if due != nil && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		// process alert, not more than maxSlaves packets in a row, then only packets of high priority slaves
+		limit := b.cfg.maxSlaves
 
-		for alert {
-			if err := b.poll(); err != nil {
-				b.ev <- Event{Type: ErrorEvent, Err: SysError} // TODO err
+		n := 0
+		for ; alert && n < 2*limit; n++ {
+			min := LowPriority
+			if n >= limit {
+				min = HighPriority
+			}
+
+			ok, err := b.pollPriority(min)
+			if err != nil {
+				b.emit(errorEvent(SysError, 0, err))
 				return
 			}
 
-			if limit == 0 {
+			if !ok {
 				// stop processing alerts TODO bus error instead?
 				break
 			}
 
-			limit--
-
 			select {
 			case s, ok := <-b.alert.state:
 				if !ok {
-					b.ev <- Event{Type: ErrorEvent, Err: SysError} // TODO b.alert.err
+					b.emit(errorEvent(SysError, 0, b.alert.cause()))
 					return
 				}
 				alert = s == 0
@@ -209,17 +421,89 @@ func (b *I2CBus) processWork() {
 				break
 			}
 		}
+
+		if alert && n >= limit {
+			b.stats.update(func(s *Stats) { s.AlertLimits++ })
+		}
 	}
 }
 
+// Delivers the packet to the slave and reports the result of the delivery (nil, ErrAck, ErrNoSlave, or ErrBus if the
+// bus is reset while waiting for a retry) to the done function, possibly after retries. The returned error is an
+// unrecoverable one.
+func (b *I2CBus) send(pkt Packet, done func(error)) error {
+	s := b.arp.slave(pkt.Addr)
+	if s == nil {
+		done(ErrNoSlave)
+		return nil
+	}
+
+	if q, ok := b.backlog[s]; ok {
+		// keep the order of packets while the previous one waits for a retry
+		b.backlog[s] = append(q, outgoing{pkt, done})
+		return nil
+	}
+
+	data := pkt.Data
+	if b.cfg.crc {
+		data = append(data[:len(data):len(data)], pec(pkt.Addr, false, data))
+	}
+
+	b.backlog[s] = nil
+	return b.transferRetry(s, pkt.Addr, false, data, func(err error) error {
+		if err == nil {
+			b.arp.touch(s)
+			b.stats.update(func(s *Stats) { s.Sent[pkt.Addr]++ })
+		}
+		done(err)
+
+		// send the packets that have been waiting
+		q := b.backlog[s]
+		delete(b.backlog, s)
+
+		for _, o := range q {
+			if b.arp.slave(s.addr) != s {
+				o.done(ErrNoSlave)
+				continue
+			}
+
+			if err := b.send(o.pkt, o.done); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
 func (b *I2CBus) poll() error {
+	_, err := b.pollPriority(LowPriority)
+	return err
+}
+
+// Polls for a packet and reads it if the polled slave has at least the given priority. The returned flag reports
+// whether the poll transaction has been processed, i.e. it is false if there are no pending packets, the packet has
+// been left to the slave or the read of the previous packet waits for a retry.
+func (b *I2CBus) pollPriority(min Priority) (bool, error) {
+	if b.reading {
+		// the slave would answer the poll with the same packet
+		return false, nil
+	}
+
 	// perform poll transaction first
-	buf := make([]byte, 2)
+	buf := make([]byte, b.bufLen(2))
 	if ok, err := b.transfer(PollAddr, true, buf); err != nil {
-		return err
+		return false, err
 	} else if !ok {
 		// no pending transfers
-		return nil
+		return false, nil
+	}
+
+	b.stats.update(func(s *Stats) { s.Polls++ })
+
+	if !b.checkCrc(PollAddr, buf) {
+		b.emit(errorEvent(CrcError, 0, errors.New("corrupted poll header")))
+		return true, nil
 	}
 
 	// check received address and length
@@ -228,28 +512,69 @@ func (b *I2CBus) poll() error {
 
 	s := b.arp.slave(addr)
 	if s == nil || n < 1 || n > MaxPacketSize {
-		b.ev <- Event{Type: ErrorEvent, Err: BusError}
-		return nil
+		b.emit(errorEvent(BusError, 0, fmt.Errorf("invalid poll header (address %02X, length %v)", addr, n)))
+		return true, nil
+	}
+
+	if s.prio < min {
+		// the slave will be polled again later
+		return false, nil
 	}
 
 	// read data from the slave
-	data := make([]byte, n)
-	ok, err := b.transfer(addr, true, data)
-	if err != nil {
-		return err
+	data := make([]byte, b.bufLen(int(n)))
+	b.reading = true
+	err := b.transferRetry(s, addr, true, data, func(err error) error {
+		b.reading = false
+
+		switch err {
+		case nil:
+			break
+
+		case ErrAck:
+			b.emit(errorEvent(AckError, addr, nil))
+			return nil
+
+		default:
+			// the slave has been unregistered or the bus reset in the meantime
+			return nil
+		}
+
+		b.arp.touch(s)
+
+		if !b.checkCrc(addr, data) {
+			b.emit(errorEvent(CrcError, addr, nil))
+			return nil
+		}
+
+		b.emit(Event{Type: PacketEvent, Pkt: &Packet{addr, data[:n]}})
+		return nil
+	})
+
+	return err == nil, err
+}
+
+// Returns the size of a read buffer for n bytes of data, including the CRC trailer if enabled.
+func (b *I2CBus) bufLen(n int) int {
+	if b.cfg.crc {
+		return n + 1
 	}
+	return n
+}
 
-	if ok {
-		s.touch()
-		b.ev <- Event{Type: PacketEvent, Pkt: &Packet{addr, data}}
-	} else {
-		b.ev <- Event{Type: ErrorEvent, Err: AckError, Addr: addr}
+// Verifies the CRC trailer of data read from the address, if enabled.
+func (b *I2CBus) checkCrc(addr Address, data []byte) bool {
+	if !b.cfg.crc {
+		return true
 	}
 
-	return nil
+	n := len(data) - 1
+	return pec(addr, true, data[:n]) == data[n]
 }
 
 func (b *I2CBus) discover() error {
+	b.stats.update(func(s *Stats) { s.Discoveries++ })
+
 	// ping silent slaves
 	if err := b.ping(); err != nil {
 		return err
@@ -259,6 +584,11 @@ func (b *I2CBus) discover() error {
 	// TODO(mbenda): some limit
 	disc := make([]byte, 9) // UDID + Address
 	for {
+		if b.configuring {
+			// a discovered slave waits for a retry of its configuration
+			return nil
+		}
+
 		if ok, err := b.transfer(ConfAddr, true, disc); err != nil {
 			return err
 		} else if !ok {
@@ -270,55 +600,216 @@ func (b *I2CBus) discover() error {
 		dev := &Device{}
 		copy(dev.Id[:], disc)
 
-		s, err := b.arp.register(dev)
+		s, prev, err := b.arp.register(dev)
+		if prev != nil && prev != s {
+			// the slave lost its previous address
+			b.emit(Event{Type: DisconnectEvent, Addr: prev.addr})
+		}
+
 		if err != nil {
 			// failed to register new slave
-			b.ev <- Event{Type: ErrorEvent, Err: RegError}
-			return nil
+			b.emit(errorEvent(RegError, 0, err))
+
+			if errors.Is(err, errTooManySlaves) {
+				// try again in the next cycle
+				return nil
+			}
+
+			// park the rejected device, so that it does not win the arbitration again
+			disc[8] = ParkAddr
+			if ok, err := b.transfer(ConfAddr, false, disc); err != nil || !ok {
+				return err
+			}
+			continue
 		}
 
 		// notify the slave
 		disc[8] = s.addr
-		if ok, err := b.transfer(ConfAddr, false, disc); err != nil {
-			return err
-		} else if !ok {
-			// device did not configure properly
-			b.arp.unregister(s)
-			b.ev <- Event{Type: ErrorEvent, Err: RegError}
+		failed := false
+		b.configuring = true
+		err = b.transferRetry(s, ConfAddr, false, disc, func(err error) error {
+			b.configuring = false
+			failed = err != nil
+			b.configured(s, prev, dev, err)
 			return nil
+		})
+
+		if err != nil || failed {
+			return err
+		}
+	}
+}
+
+// Completes the registration of a discovered slave according to the result of its configuration.
+func (b *I2CBus) configured(s, prev *slave, dev *Device, err error) {
+	switch err {
+	case ErrNoSlave, ErrBus:
+		// the bus has been reset in the meantime
+		return
+
+	case ErrAck:
+		// device did not configure properly
+		b.arp.unregister(s)
+		if prev == s {
+			b.emit(Event{Type: DisconnectEvent, Addr: s.addr})
 		}
+		b.emit(errorEvent(RegError, 0, ErrAck))
+		return
+	}
+
+	if err := b.cfg.leases.update(dev.Id, s.addr); err != nil {
+		b.cfg.log.Log(WarnLevel, "failed to store lease",
+			"addr", addrString(s.addr), "udid", udidString(dev.Id), "err", err)
+	}
 
-		b.ev <- Event{Type: ConnectEvent, Addr: s.addr, Dev: dev}
+	if prev == s {
+		b.emit(Event{Type: ReregisterEvent, Addr: s.addr, Dev: dev})
+	} else {
+		b.emit(Event{Type: ConnectEvent, Addr: s.addr, Dev: dev})
 	}
 }
 
 func (b *I2CBus) ping() error {
-	for _, s := range b.arp.slaves {
-		if s == nil || s.active() {
+	// ping slaves of higher priority first
+	for _, s := range b.arp.byPriority() {
+		if s.active() {
 			continue
 		}
 
-		// perform "ping" transaction
-		ok, err := b.transfer(s.addr, false, make([]byte, 0))
+		ok, err := b.probe(s.addr)
 		if err != nil {
 			return err
 		}
 
 		if ok {
-			s.touch()
+			b.arp.touch(s)
 			continue
 		}
 
 		// slave did not answered
 		// TODO(mbenda): error counter?
 		b.arp.unregister(s)
-		b.ev <- Event{Type: DisconnectEvent, Addr: s.addr}
+		b.emit(Event{Type: DisconnectEvent, Addr: s.addr})
 	}
 
 	return nil
 }
 
+// Performs the "ping" transaction with the slave: an empty write, or a one-byte read if the transport does not support
+// zero-length transactions.
+func (b *I2CBus) probe(addr Address) (bool, error) {
+	if !b.noZeroLen {
+		ok, err := b.transfer(addr, false, make([]byte, 0))
+		if err != ErrZeroLength {
+			return ok, err
+		}
+
+		b.cfg.log.Log(WarnLevel, "zero-length transfers not supported, pinging by reads")
+		b.noZeroLen = true
+	}
+
+	return b.transfer(addr, true, make([]byte, 1))
+}
+
 func (b *I2CBus) transfer(addr Address, read bool, data []byte) (bool, error) {
+	ok, err := b.tr.Transfer(addr, read, data)
+	b.cfg.log.Log(DebugLevel, "transfer", "addr", addrString(addr), "read", read, "len", len(data), "ack", ok)
+
+	// broadcast reads are not acknowledged when there is nothing to read
+	if !ok && err == nil && addr != CallAddr && addr != PollAddr && (addr != ConfAddr || !read) {
+		b.stats.update(func(s *Stats) { s.Nacks++ })
+	}
+
+	return ok, err
+}
+
+// Performs the transaction at the address on behalf of the slave. While the transaction is not acknowledged, its
+// retries are scheduled according to the retry policy of the address, so that the work loop does not wait for them.
+// The done function gets the final result: nil, ErrAck, ErrNoSlave if the slave has been unregistered in the
+// meantime, or ErrBus if the retry has been abandoned by a reset of the bus.
+func (b *I2CBus) transferRetry(s *slave, addr Address, read bool, data []byte, done func(error) error) error {
+	p := b.cfg.retryPolicy(addr)
+
+	var attempt func(n int) error
+	attempt = func(n int) error {
+		if b.arp.slave(s.addr) != s {
+			return done(ErrNoSlave)
+		}
+
+		if n > 1 {
+			b.stats.update(func(s *Stats) { s.Retries++ })
+		}
+
+		ok, err := b.transfer(addr, read, data)
+		switch {
+		case err != nil:
+			return err
+		case ok:
+			return done(nil)
+		case n >= p.Attempts:
+			return done(ErrAck)
+		}
+
+		// back off before the next attempt
+		b.schedule(p.Delay(n), func(abandoned error) error {
+			if abandoned != nil {
+				return done(abandoned)
+			}
+			return attempt(n + 1)
+		})
+		return nil
+	}
+
+	return attempt(1)
+}
+
+// Schedules the function to be run in the work loop after the delay.
+func (b *I2CBus) schedule(d time.Duration, fn func(abandoned error) error) {
+	r := retry{time.Now().Add(d), fn}
+
+	i := sort.Search(len(b.retries), func(i int) bool {
+		return b.retries[i].at.After(r.at)
+	})
+
+	b.retries = append(b.retries, retry{})
+	copy(b.retries[i+1:], b.retries[i:])
+	b.retries[i] = r
+}
+
+// Runs the scheduled retries that are due at the given time.
+func (b *I2CBus) retry(now time.Time) error {
+	for len(b.retries) > 0 && !b.retries[0].at.After(now) {
+		r := b.retries[0]
+		b.retries = b.retries[1:]
+
+		if err := r.fn(nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Waits for all scheduled retries and runs them, used when the bus is shutting down. The retries are abandoned if the
+// bus is closed in the meantime.
+func (b *I2CBus) flush() error {
+	for len(b.retries) > 0 {
+		select {
+		case <-time.After(time.Until(b.retries[0].at)):
+			if err := b.retry(time.Now()); err != nil {
+				return err
+			}
+
+		case <-b.done:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Transfer implements the Transport interface using the I2C_RDWR ioctl.
+func (d *i2cDev) Transfer(addr Address, read bool, data []byte) (bool, error) {
 	const (
 		I2cMRd  = 0x0001
 		I2cRdwr = 0x0707
@@ -328,7 +819,10 @@ func (b *I2CBus) transfer(addr Address, read bool, data []byte) (bool, error) {
 	msg := i2cMsg{
 		addr: uint16(addr),
 		len:  uint16(len(data)),
-		buf:  uintptr(unsafe.Pointer(&data[0])),
+	}
+
+	if len(data) > 0 {
+		msg.buf = uintptr(unsafe.Pointer(&data[0]))
 	}
 
 	if read {
@@ -338,11 +832,31 @@ func (b *I2CBus) transfer(addr Address, read bool, data []byte) (bool, error) {
 	// prepare RDWR ioctl data
 	rdwr := i2cRdwrIoctlData{uintptr(unsafe.Pointer(&msg)), 1}
 
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(b.i2c), uintptr(I2cRdwr), uintptr(unsafe.Pointer(&rdwr)))
-	if errno != 0 {
-		// TODO(mbenda): determine which errors are fatal... or count number of successive errors
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(d.fd), uintptr(I2cRdwr), uintptr(unsafe.Pointer(&rdwr)))
+	switch errno {
+	case 0:
+		break
+
+	case syscall.EBADF, syscall.EFAULT, syscall.ENODEV, syscall.ENOTTY:
+		// the device is unusable
+		return false, os.NewSyscallError("ioctl I2C_RDWR", errno)
+
+	case syscall.EINVAL, syscall.EOPNOTSUPP:
+		// the adapter refuses the message, e.g. because of its I2C_AQ_NO_ZERO_LEN quirk
+		if len(data) == 0 {
+			return false, ErrZeroLength
+		}
+		return false, nil
+
+	default:
+		// TODO(mbenda): count number of successive errors
 		return false, nil
 	}
 
 	return true, nil
 }
+
+// Close implements the Transport interface.
+func (d *i2cDev) Close() error {
+	return syscall.Close(d.fd)
+}
@@ -0,0 +1,785 @@
+package zbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testBus(tr Transport, opts ...Option) *I2CBus {
+	return newI2CBus(tr, nil, newConfig(opts))
+}
+
+func nextEvent(t *testing.T, b *I2CBus) Event {
+	t.Helper()
+
+	select {
+	case ev := <-b.ev.Events():
+		return ev
+	default:
+		t.Fatalf("No event emitted")
+		return Event{}
+	}
+}
+
+func noEvent(t *testing.T, b *I2CBus) {
+	t.Helper()
+
+	select {
+	case ev := <-b.ev.Events():
+		t.Fatalf("Unexpected event %+v", ev)
+	default:
+	}
+}
+
+// Runs all scheduled retries.
+func retryAll(t *testing.T, b *I2CBus) {
+	t.Helper()
+
+	if err := b.retry(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+}
+
+// Delivers the packet including retries and returns the result of the delivery.
+func deliver(t *testing.T, b *I2CBus, pkt Packet) error {
+	t.Helper()
+
+	var res error
+	if err := b.send(pkt, func(err error) { res = err }); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	retryAll(t, b)
+
+	return res
+}
+
+// TestDiscover tests that unconfigured slaves are registered and configured.
+func TestDiscover(t *testing.T) {
+	mem := NewMemTransport()
+	m1 := mem.Attach(Udid{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+	m2 := mem.Attach(Udid{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 0x00, 0x00})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+
+	for _, m := range []*MemSlave{m1, m2} {
+		ev := nextEvent(t, b)
+		if ev.Type != ConnectEvent || ev.Dev == nil || ev.Dev.Id != m.Id() {
+			t.Fatalf("Invalid connect event %+v", ev)
+		}
+
+		if m.Addr() != ev.Addr {
+			t.Errorf("Slave configured with address %02x, %02x expected", m.Addr(), ev.Addr)
+		}
+	}
+
+	if b.arp.num != 2 {
+		t.Errorf("Invalid number of registered devices, 2 expected, got %v", b.arp.num)
+	}
+
+	// nothing more to discover
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	noEvent(t, b)
+}
+
+// TestDiscoverNack tests that a slave that fails to accept its address is not registered.
+func TestDiscoverNack(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+	m.Nack(1)
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != ErrorEvent || ev.Err != RegError {
+		t.Fatalf("Registration error expected, got %+v", ev)
+	}
+
+	if b.arp.num != 0 || m.Addr() != 0 {
+		t.Errorf("Slave registered despite failed configuration")
+	}
+}
+
+// TestDiscoverDenied tests that a device rejected by the policy does not keep other devices from registering.
+func TestDiscoverDenied(t *testing.T) {
+	mem := NewMemTransport()
+	denied := mem.Attach(Udid{0x01})
+	allowed := mem.Attach(Udid{0x02})
+
+	b := testBus(mem, WithPolicy(Policy{Deny: [][]byte{{0x01}}}))
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != ErrorEvent || ev.Err != RegError || !errors.Is(ev.Cause, ErrDenied) {
+		t.Fatalf("Registration error expected, got %+v", ev)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != ConnectEvent || ev.Addr != allowed.Addr() || ev.Dev.Id != allowed.Id() {
+		t.Fatalf("Connect event expected, got %+v", ev)
+	}
+
+	if denied.Addr() != ParkAddr {
+		t.Errorf("Denied device not parked: %02x", denied.Addr())
+	}
+
+	// the denied device is not reported again
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	noEvent(t, b)
+
+	if b.arp.num != 1 {
+		t.Errorf("Invalid number of registered devices, 1 expected, got %v", b.arp.num)
+	}
+}
+
+// TestPoll tests reception of packets from slaves.
+func TestPoll(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	data := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	m.Queue(data)
+
+	if !mem.Alert() {
+		t.Fatalf("Alert not signalled")
+	}
+
+	if err := b.poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+
+	ev := nextEvent(t, b)
+	if ev.Type != PacketEvent || ev.Pkt.Addr != m.Addr() || !bytes.Equal(ev.Pkt.Data, data) {
+		t.Fatalf("Invalid packet event %+v", ev)
+	}
+
+	if mem.Alert() {
+		t.Errorf("Alert still signalled")
+	}
+
+	// no pending packets
+	if err := b.poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	noEvent(t, b)
+}
+
+// TestSend tests delivery of packets to slaves.
+func TestSend(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	go b.Send(Packet{Addr: m.Addr(), Data: []byte{0x42}})
+	if err := (<-b.work)(); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	noEvent(t, b)
+
+	if in := m.Received(); len(in) != 1 || !bytes.Equal(in[0], []byte{0x42}) {
+		t.Errorf("Invalid packets received: %v", in)
+	}
+
+	// sending to an unknown address
+	go b.Send(Packet{Addr: m.Addr() + 1, Data: []byte{0x42}})
+	if err := (<-b.work)(); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != ErrorEvent || ev.Err != AckError || ev.Addr != m.Addr()+1 {
+		t.Fatalf("Ack error expected, got %+v", ev)
+	}
+}
+
+// TestPing tests that silent slaves are pinged and unregistered when they do not respond.
+func TestPing(t *testing.T) {
+	mem := NewMemTransport()
+	m1 := mem.Attach(Udid{0x01})
+	m2 := mem.Attach(Udid{0x02})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+	nextEvent(t, b)
+
+	// let both slaves go silent for too long
+	for _, s := range b.arp.slaves {
+		if s != nil {
+			s.lastSeen = time.Now().Add(-2 * silenceLimit)
+		}
+	}
+
+	m2.Silence(true)
+
+	if err := b.ping(); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	ev := nextEvent(t, b)
+	if ev.Type != DisconnectEvent || ev.Addr != m2.Addr() {
+		t.Fatalf("Disconnect event expected, got %+v", ev)
+	}
+	noEvent(t, b)
+
+	if s := b.arp.slave(m1.Addr()); s == nil || !s.active() {
+		t.Errorf("Responding slave not active")
+	}
+
+	if b.arp.num != 1 {
+		t.Errorf("Invalid number of registered devices, 1 expected, got %v", b.arp.num)
+	}
+}
+
+// TestPingZeroLength tests that slaves are pinged by reads if the transport refuses zero-length transactions.
+func TestPingZeroLength(t *testing.T) {
+	mem := NewMemTransport()
+	m1 := mem.Attach(Udid{0x01})
+	m2 := mem.Attach(Udid{0x02})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+	nextEvent(t, b)
+
+	for _, s := range b.arp.slaves {
+		if s != nil {
+			s.lastSeen = time.Now().Add(-2 * silenceLimit)
+		}
+	}
+
+	mem.RefuseZeroLength()
+	m2.Silence(true)
+
+	if err := b.ping(); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != DisconnectEvent || ev.Addr != m2.Addr() {
+		t.Fatalf("Disconnect event expected, got %+v", ev)
+	}
+	noEvent(t, b)
+
+	if s := b.arp.slave(m1.Addr()); s == nil || !s.active() {
+		t.Errorf("Responding slave not active")
+	}
+
+	if !b.noZeroLen {
+		t.Errorf("Zero-length transactions still used")
+	}
+}
+
+// TestSendSync tests that the result of a delivery is reported to the sender.
+func TestSendSync(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	send := func(pkt Packet) error {
+		res := make(chan error)
+		go func() {
+			res <- b.SendSync(context.Background(), pkt)
+		}()
+
+		if err := (<-b.work)(); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+
+		return <-res
+	}
+
+	if err := send(Packet{Addr: m.Addr(), Data: []byte{0x42}}); err != nil {
+		t.Errorf("Delivery failed: %v", err)
+	}
+
+	m.Nack(1)
+	if err := send(Packet{Addr: m.Addr(), Data: []byte{0x42}}); err != ErrAck {
+		t.Errorf("ErrAck expected, got %v", err)
+	}
+
+	if err := send(Packet{Addr: m.Addr() + 1, Data: []byte{0x42}}); err != ErrNoSlave {
+		t.Errorf("ErrNoSlave expected, got %v", err)
+	}
+	noEvent(t, b)
+
+	close(b.term)
+	if err := b.SendSync(context.Background(), Packet{Addr: m.Addr()}); err != ErrClosed {
+		t.Errorf("ErrClosed expected, got %v", err)
+	}
+}
+
+// TestCrc tests CRC protection of packets in both directions.
+func TestCrc(t *testing.T) {
+	mem := NewMemTransport(WithCRC())
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem, WithCRC())
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	// slave to master
+	data := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	m.Queue(data)
+	m.Queue(data)
+	m.Corrupt(1)
+
+	if err := b.poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != ErrorEvent || ev.Err != CrcError || ev.Addr != m.Addr() {
+		t.Fatalf("CRC error expected, got %+v", ev)
+	}
+
+	if err := b.poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != PacketEvent || !bytes.Equal(ev.Pkt.Data, data) {
+		t.Fatalf("Invalid packet event %+v", ev)
+	}
+
+	// master to slave
+	if err := deliver(t, b, Packet{Addr: m.Addr(), Data: data}); err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+
+	if in := m.Received(); len(in) != 1 || !bytes.Equal(in[0], data) {
+		t.Errorf("Invalid packets received: %v", in)
+	}
+}
+
+// TestRetry tests that transactions which are not acknowledged are retried.
+func TestRetry(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+	m.Nack(2)
+
+	b := testBus(mem, WithRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond}))
+
+	// configuration is retried
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	noEvent(t, b)
+	retryAll(t, b)
+
+	if ev := nextEvent(t, b); ev.Type != ConnectEvent {
+		t.Fatalf("Connect event expected, got %+v", ev)
+	}
+
+	// sending is retried
+	m.Nack(2)
+	if err := deliver(t, b, Packet{Addr: m.Addr(), Data: []byte{0x42}}); err != nil {
+		t.Errorf("Delivery failed: %v", err)
+	}
+
+	// until the attempts are used up
+	m.Nack(3)
+	if err := deliver(t, b, Packet{Addr: m.Addr(), Data: []byte{0x42}}); err != ErrAck {
+		t.Errorf("ErrAck expected, got %v", err)
+	}
+
+	if in := m.Received(); len(in) != 1 {
+		t.Errorf("Invalid number of packets received: %v", len(in))
+	}
+
+	// reading polled packets is retried
+	m.Queue([]byte{0x42})
+	m.Nack(2)
+	if err := b.poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	noEvent(t, b)
+
+	// the slave is not polled again until its packet is read
+	if ok, err := b.pollPriority(LowPriority); ok || err != nil {
+		t.Fatalf("Slave polled during retry: %v, %v", ok, err)
+	}
+	retryAll(t, b)
+
+	if ev := nextEvent(t, b); ev.Type != PacketEvent {
+		t.Fatalf("Packet event expected, got %+v", ev)
+	}
+}
+
+// TestRetrySchedule tests that retries do not hold up other slaves and keep the order of packets.
+func TestRetrySchedule(t *testing.T) {
+	mem := NewMemTransport()
+	m1 := mem.Attach(Udid{0x01})
+	m2 := mem.Attach(Udid{0x02})
+
+	b := testBus(mem, WithRetry(RetryPolicy{Attempts: 2, Backoff: time.Hour}))
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+	nextEvent(t, b)
+
+	var res []error
+	send := func(addr Address, data byte) {
+		err := b.send(Packet{Addr: addr, Data: []byte{data}}, func(err error) {
+			res = append(res, err)
+		})
+
+		if err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	m1.Nack(1)
+	send(m1.Addr(), 0x01)
+	send(m1.Addr(), 0x02)
+	send(m2.Addr(), 0x03)
+
+	if len(res) != 1 || res[0] != nil || len(m2.Received()) != 1 {
+		t.Fatalf("Packet to another slave not delivered: %v", res)
+	}
+
+	if len(m1.Received()) != 0 || len(b.retries) != 1 {
+		t.Fatalf("Retry not scheduled")
+	}
+
+	// the retry is due in an hour
+	if err := b.retry(time.Now()); err != nil || len(b.retries) != 1 {
+		t.Fatalf("Retry run too early: %v", err)
+	}
+
+	retryAll(t, b)
+
+	if len(res) != 3 || res[1] != nil || res[2] != nil {
+		t.Fatalf("Packets not delivered: %v", res)
+	}
+
+	if in := m1.Received(); len(in) != 2 || in[0][0] != 0x01 || in[1][0] != 0x02 {
+		t.Errorf("Packets not delivered in order: %x", in)
+	}
+}
+
+// TestResetRetry tests that a reset abandons the scheduled retries and the packets waiting for them.
+func TestResetRetry(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem, WithRetry(RetryPolicy{Attempts: 2, Backoff: time.Hour}))
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	m.Nack(1)
+
+	var res []error
+	for _, data := range []byte{0x01, 0x02} {
+		err := b.send(Packet{Addr: m.Addr(), Data: []byte{data}}, func(err error) {
+			res = append(res, err)
+		})
+
+		if err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	b.reading, b.configuring = true, true
+
+	if err := b.reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+
+	if len(res) != 2 || res[0] != ErrBus || res[1] != ErrBus {
+		t.Errorf("Packets not abandoned: %v", res)
+	}
+
+	if len(b.retries) != 0 || len(b.backlog) != 0 || b.reading || b.configuring {
+		t.Errorf("State not cleared")
+	}
+
+	if ev := nextEvent(t, b); ev.Type != ResetEvent {
+		t.Errorf("Reset event expected, got %+v", ev)
+	}
+
+	retryAll(t, b)
+
+	if len(m.Received()) != 0 || len(res) != 2 {
+		t.Errorf("Abandoned packet delivered")
+	}
+}
+
+// TestPollPriority tests that packets of slaves below the requested priority are left pending.
+func TestPollPriority(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem, WithPolicy(Policy{High: [][]byte{{0x02}}}))
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	m.Queue([]byte{0x42})
+	if ok, err := b.pollPriority(HighPriority); ok || err != nil {
+		t.Fatalf("Packet of a normal priority slave read: %v, %v", ok, err)
+	}
+	noEvent(t, b)
+
+	if !mem.Alert() {
+		t.Fatalf("Packet not pending")
+	}
+
+	if ok, err := b.pollPriority(NormalPriority); !ok || err != nil {
+		t.Fatalf("Poll failed: %v, %v", ok, err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != PacketEvent {
+		t.Fatalf("Packet event expected, got %+v", ev)
+	}
+}
+
+// TestReregister tests that a rebooted slave is reported according to the re-registration mode.
+func TestReregister(t *testing.T) {
+	for _, mode := range []Reregistration{Reconnect, KeepAddress} {
+		mem := NewMemTransport()
+		m := mem.Attach(Udid{0x01})
+
+		b := testBus(mem, WithReregistration(mode))
+		if err := b.discover(); err != nil {
+			t.Fatalf("Discovery failed: %v", err)
+		}
+		nextEvent(t, b)
+
+		addr := m.Addr()
+		m.Reset()
+
+		if err := b.discover(); err != nil {
+			t.Fatalf("Discovery failed: %v", err)
+		}
+
+		if mode == Reconnect {
+			if ev := nextEvent(t, b); ev.Type != DisconnectEvent || ev.Addr != addr {
+				t.Fatalf("Disconnect event expected, got %+v", ev)
+			}
+
+			if ev := nextEvent(t, b); ev.Type != ConnectEvent || ev.Addr != m.Addr() {
+				t.Fatalf("Connect event expected, got %+v", ev)
+			}
+		} else {
+			if ev := nextEvent(t, b); ev.Type != ReregisterEvent || ev.Addr != addr || m.Addr() != addr {
+				t.Fatalf("Re-register event expected, got %+v", ev)
+			}
+		}
+		noEvent(t, b)
+
+		if b.arp.num != 1 {
+			t.Errorf("Invalid number of registered devices, 1 expected, got %v", b.arp.num)
+		}
+	}
+}
+
+// TestShutdown tests that the submitted work is done before the slaves are notified and the bus stops.
+func TestShutdown(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+	addr := m.Addr()
+
+	go b.Send(Packet{Addr: addr, Data: []byte{0x42}})
+	send := <-b.work
+
+	res := make(chan error, 1)
+	go func() {
+		res <- b.Shutdown(context.Background())
+	}()
+	shutdown := <-b.work
+
+	if err := send(); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if err := shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	if in := m.Received(); len(in) != 1 || !bytes.Equal(in[0], []byte{0x42}) {
+		t.Errorf("Packet not delivered: %x", in)
+	}
+
+	if m.Addr() != 0 {
+		t.Errorf("Slave not notified")
+	}
+
+	select {
+	case <-b.done:
+		break
+	default:
+		t.Fatalf("Work loop not terminated")
+	}
+
+	close(b.term)
+	if err := <-res; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+
+	// the bus does not accept any work
+	b.Send(Packet{Addr: addr, Data: []byte{0x42}})
+	b.Reset()
+	if err := b.SendSync(context.Background(), Packet{Addr: addr}); err != ErrClosed {
+		t.Errorf("ErrClosed expected, got %v", err)
+	}
+	b.Close()
+
+	// the context ends before the bus is shut down
+	b = testBus(mem)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.Shutdown(ctx); err != context.Canceled {
+		t.Errorf("context.Canceled expected, got %v", err)
+	}
+	b.Close()
+}
+
+// TestStats tests the counters of bus operations.
+func TestStats(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem, WithRetry(RetryPolicy{Attempts: 2, Backoff: time.Millisecond}))
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+	addr := m.Addr()
+
+	if err := deliver(t, b, Packet{Addr: addr, Data: []byte{0x42}}); err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+
+	m.Nack(2)
+	if err := deliver(t, b, Packet{Addr: addr, Data: []byte{0x42}}); err != ErrAck {
+		t.Fatalf("ErrAck expected, got %v", err)
+	}
+
+	m.Queue([]byte{0x42})
+	if err := b.poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	// the statistics are read without the work loop, which is not running here
+	s := b.Stats()
+
+	exp := Stats{
+		Sent:        map[Address]uint64{addr: 1},
+		Received:    map[Address]uint64{addr: 1},
+		Nacks:       2,
+		Retries:     1,
+		Discoveries: 1,
+		Polls:       1,
+		Slaves:      1,
+	}
+
+	if !reflect.DeepEqual(s, exp) {
+		t.Errorf("Invalid statistics %+v, %+v expected", s, exp)
+	}
+}
+
+// TestBusDevices tests that registered slaves are listed without the work loop, which is not running here.
+func TestBusDevices(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b := testBus(mem)
+	if err := b.discover(); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	nextEvent(t, b)
+
+	if devs := b.Devices(); len(devs) != 1 || devs[0].Addr != m.Addr() || devs[0].Dev.Id != (Udid{0x01}) {
+		t.Errorf("Invalid devices %+v", devs)
+	}
+
+	if dev, ok := b.Device(m.Addr()); !ok || !dev.Active {
+		t.Errorf("Invalid device %+v", dev)
+	}
+
+	// a closed bus has no devices
+	close(b.term)
+	if devs := b.Devices(); devs != nil {
+		t.Errorf("Devices of a closed bus: %+v", devs)
+	}
+}
+
+// TestTransportAlert tests a bus that takes the alert signal from an in-memory transport.
+func TestTransportAlert(t *testing.T) {
+	mem := NewMemTransport()
+	m := mem.Attach(Udid{0x01})
+
+	b, err := NewI2CBusTransport(mem, nil, WithDiscoveryInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create bus: %v", err)
+	}
+	defer b.Close()
+
+	next := func() Event {
+		t.Helper()
+
+		select {
+		case ev := <-b.Events():
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("No event emitted")
+			return Event{}
+		}
+	}
+
+	for next().Type != ConnectEvent {
+		// the reset of the bus comes first
+	}
+
+	m.Queue([]byte{0x42})
+	if ev := next(); ev.Type != PacketEvent || ev.Pkt.Addr != m.Addr() || !bytes.Equal(ev.Pkt.Data, []byte{0x42}) {
+		t.Errorf("Invalid packet event %+v", ev)
+	}
+
+	if _, err := NewI2CBusTransport(&i2cDev{-1}, nil); err == nil {
+		t.Errorf("Bus without an alert signal created")
+	}
+}
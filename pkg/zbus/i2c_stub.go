@@ -18,8 +18,30 @@ package zbus
 
 import "errors"
 
+// I2CBus stands for the hardware bus, which is not supported on this platform. It exists so that code using the bus
+// builds on all platforms, the constructors never return an instance.
+type I2CBus struct {
+	Bus
+}
+
 // NewI2CBus in this file just returns a "non implemented" error. The real implementation is in the Linux-specific
 // i2c_linux.go file.
-func NewI2CBus(_ int, _ int) (Bus, error) {
+func NewI2CBus(_ int, _ AlertPin, _ ...Option) (*I2CBus, error) {
+	return nil, errors.New("hardware zen-bus bus is not supported on this platform")
+}
+
+// NewI2CBusTransport in this file just returns a "non implemented" error. The real implementation is in the
+// Linux-specific i2c_linux.go file.
+func NewI2CBusTransport(_ Transport, _ *AlertPin, _ ...Option) (*I2CBus, error) {
 	return nil, errors.New("hardware zen-bus bus is not supported on this platform")
 }
+
+// DroppedEvents returns the number of events dropped according to the overflow policy.
+func (b *I2CBus) DroppedEvents() uint64 {
+	return 0
+}
+
+// Stats returns the statistics of the bus.
+func (b *I2CBus) Stats() Stats {
+	return Stats{}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bustest provides a fake zbus.Bus for testing the buses layered on top of another bus.
+package bustest
+
+import (
+	"context"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capacity of the channels of the fake bus, enough for a message of the maximum number of fragments
+const capacity = 256
+
+// Bus is a zbus.Bus that passes sent packets to the test and delivers the events injected by the test.
+type Bus struct {
+	ev        chan zbus.Event
+	sent      chan zbus.Packet
+	abandoned chan zbus.Packet
+
+	mu    sync.Mutex
+	err   error // result of SendSync
+	stall bool  // SendSync waits until its context ends
+}
+
+// New creates a fake bus.
+func New() *Bus {
+	return &Bus{
+		ev:        make(chan zbus.Event, capacity),
+		sent:      make(chan zbus.Packet, capacity),
+		abandoned: make(chan zbus.Packet, capacity),
+	}
+}
+
+// the remaining methods of zbus.Bus
+
+func (b *Bus) Close()                                               { close(b.ev) }
+func (b *Bus) Shutdown(context.Context) error                       { b.Close(); return nil }
+func (b *Bus) Reset()                                               { b.ev <- zbus.Event{Type: zbus.ResetEvent} }
+func (b *Bus) Send(pkt zbus.Packet)                                 { b.sent <- pkt }
+func (b *Bus) Events() <-chan zbus.Event                            { return b.ev }
+func (b *Bus) Subscribe(...zbus.Filter) (<-chan zbus.Event, func()) { return nil, func() {} }
+func (b *Bus) Devices() []zbus.DeviceInfo                           { return nil }
+func (b *Bus) Device(zbus.Address) (zbus.DeviceInfo, bool)          { return zbus.DeviceInfo{}, false }
+
+// SendSync passes the packet to the test and reports the result set by Fail, successful delivery by default. A stalled
+// bus waits until the context ends.
+func (b *Bus) SendSync(ctx context.Context, pkt zbus.Packet) error {
+	b.sent <- pkt
+
+	b.mu.Lock()
+	err, stall := b.err, b.stall
+	b.mu.Unlock()
+
+	if stall {
+		<-ctx.Done()
+		b.abandoned <- pkt
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// Stall makes SendSync wait until its context ends, see Abandoned.
+func (b *Bus) Stall() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stall = true
+}
+
+// Abandoned waits for the next packet whose SendSync has been abandoned by its context on a stalled bus.
+func (b *Bus) Abandoned(t *testing.T) zbus.Packet {
+	t.Helper()
+
+	select {
+	case pkt := <-b.abandoned:
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatalf("No packet abandoned")
+		return zbus.Packet{}
+	}
+}
+
+// Fail makes SendSync return the error, nil restores successful delivery.
+func (b *Bus) Fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.err = err
+}
+
+// Emit delivers the event to the Events channel.
+func (b *Bus) Emit(ev zbus.Event) {
+	b.ev <- ev
+}
+
+// Receive delivers a packet received from the slave with the given address.
+func (b *Bus) Receive(addr zbus.Address, data ...byte) {
+	b.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &zbus.Packet{Addr: addr, Data: data}})
+}
+
+// Next waits for the next sent packet.
+func (b *Bus) Next(t *testing.T) zbus.Packet {
+	t.Helper()
+
+	select {
+	case pkt := <-b.sent:
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatalf("No packet sent")
+		return zbus.Packet{}
+	}
+}
+
+// Take returns all packets sent so far.
+func (b *Bus) Take() []zbus.Packet {
+	var sent []zbus.Packet
+	for {
+		select {
+		case pkt := <-b.sent:
+			sent = append(sent, pkt)
+		default:
+			return sent
+		}
+	}
+}
+
+// Loop delivers all packets sent so far back as received ones and returns them.
+func (b *Bus) Loop() []zbus.Packet {
+	sent := b.Take()
+	for i := range sent {
+		b.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &sent[i]})
+	}
+
+	return sent
+}
+
+// NextEvent waits for the next event of the bus.
+func NextEvent(t *testing.T, b zbus.Bus) zbus.Event {
+	t.Helper()
+
+	select {
+	case ev := <-b.Events():
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("No event emitted")
+		return zbus.Event{}
+	}
+}
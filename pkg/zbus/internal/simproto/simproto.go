@@ -0,0 +1,36 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package simproto holds the wire constants of the zen-bus simulator protocol shared by the master (zbus.SimBus) and
+// the slave (simslave) side.
+package simproto
+
+const (
+	// Magic starts the handshake of both sides.
+	Magic uint16 = 0x7082
+
+	// Version is the protocol version, the sides are compatible if the major versions (high bytes) match.
+	Version uint16 = 0x0000
+)
+
+const (
+	// CmdPacket is followed by the length and data of a packet.
+	CmdPacket uint8 = 0x00
+
+	// CmdConf is sent by the master to assign the slave its address.
+	CmdConf uint8 = 0x01
+
+	// CmdQuit is sent by the master before it closes the connection.
+	CmdQuit uint8 = 0xFF
+)
@@ -0,0 +1,150 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wrap holds the plumbing shared by the buses layered on top of another zbus.Bus (frag, reliable and rpc).
+// Such a bus takes over the events of the underlying bus in its event loop and delivers its own events by a Loop.
+package wrap
+
+import (
+	"context"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"sync"
+)
+
+// Base implements the methods of zbus.Bus that a layered bus passes through to the underlying bus, together with
+// access to the events delivered by its Loop. It is meant to be embedded.
+type Base struct {
+	bus  zbus.Bus
+	loop *Loop
+}
+
+// Loop delivers the events emitted by the event loop of a layered bus to its Events channel and subscribers, and
+// queues the work posted to the event loop from outside.
+type Loop struct {
+	ev *zbus.Dispatcher
+
+	mu     sync.Mutex
+	posted []func()
+	signal chan struct{} // ready while there is posted work
+	closed bool
+}
+
+// New creates the plumbing of a bus layered on top of the given bus. The options configure the events of the layered
+// bus, see zbus.NewDispatcher.
+func New(b zbus.Bus, opts ...zbus.Option) (Base, *Loop) {
+	l := &Loop{
+		ev:     zbus.NewDispatcher(opts...),
+		signal: make(chan struct{}, 1),
+	}
+
+	return Base{bus: b, loop: l}, l
+}
+
+// Close closes the underlying bus.
+func (b *Base) Close() {
+	b.loop.ev.Abort()
+	b.bus.Close()
+}
+
+// Shutdown shuts down the underlying bus gracefully.
+func (b *Base) Shutdown(ctx context.Context) error {
+	return b.bus.Shutdown(ctx)
+}
+
+// Reset resets the underlying bus.
+func (b *Base) Reset() {
+	b.bus.Reset()
+}
+
+// Events provides access to the channel of bus events.
+func (b *Base) Events() <-chan zbus.Event {
+	return b.loop.ev.Events()
+}
+
+// Subscribe returns a channel of the selected bus events.
+func (b *Base) Subscribe(filters ...zbus.Filter) (<-chan zbus.Event, func()) {
+	return b.loop.ev.Subscribe(filters...)
+}
+
+// Devices returns information about all slaves registered on the underlying bus.
+func (b *Base) Devices() []zbus.DeviceInfo {
+	return b.bus.Devices()
+}
+
+// Device returns information about the slave with the given address.
+func (b *Base) Device(addr zbus.Address) (zbus.DeviceInfo, bool) {
+	return b.bus.Device(addr)
+}
+
+// Emit delivers the event to the Events channel and subscribers. It must be called by the event loop.
+func (l *Loop) Emit(ev zbus.Event) {
+	l.ev.Emit(ev)
+}
+
+// Post queues the function to be run by the event loop. Unlike a send to a channel served by the loop, it never
+// blocks the caller, even while the loop waits for the consumer of the Events channel. It reports whether the function
+// has been queued, i.e. whether the loop has not terminated yet.
+func (l *Loop) Post(fn func()) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return false
+	}
+
+	l.posted = append(l.posted, fn)
+
+	select {
+	case l.signal <- struct{}{}:
+	default:
+		// the loop has already been signalled
+	}
+
+	return true
+}
+
+// Report posts the event to be emitted by the event loop.
+func (l *Loop) Report(ev zbus.Event) {
+	l.Post(func() {
+		l.Emit(ev)
+	})
+}
+
+// Posted returns a channel that is ready when the event loop should call Run.
+func (l *Loop) Posted() <-chan struct{} {
+	return l.signal
+}
+
+// Run runs the posted functions in the order they were posted.
+func (l *Loop) Run() {
+	l.mu.Lock()
+	posted := l.posted
+	l.posted = nil
+	l.mu.Unlock()
+
+	for _, fn := range posted {
+		fn()
+	}
+}
+
+// Close closes the Events channel and all subscriptions once the event loop terminates. The work posted so far is
+// dropped.
+func (l *Loop) Close() {
+	l.mu.Lock()
+	l.posted = nil
+	l.closed = true
+	l.mu.Unlock()
+
+	l.ev.Close()
+}
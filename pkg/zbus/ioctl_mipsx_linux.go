@@ -0,0 +1,27 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build mips mipsle mips64 mips64le ppc64 ppc64le
+
+package zbus
+
+// ioctl request encoding, see <asm/ioctl.h> of the MIPS and PowerPC architectures
+const (
+	iocWrite = 4
+	iocRead  = 2
+
+	iocTypeShift = 8
+	iocSizeShift = 16
+	iocDirShift  = 29
+)
@@ -0,0 +1,223 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LeaseStore persists the addresses assigned to slave devices, so that a known device gets its previous address back
+// whenever the address is free.
+type LeaseStore interface {
+	// Load returns all stored leases.
+	Load() (map[Udid]Address, error)
+
+	// Store records that the device has been assigned the address. Leases of the address held by other devices are
+	// dropped.
+	Store(id Udid, addr Address) error
+}
+
+// FileLeaseStore is a LeaseStore that keeps leases in a JSON file. The file contains an object that maps hex encoded
+// UDIDs to addresses.
+type FileLeaseStore struct {
+	mu     sync.Mutex
+	path   string
+	leases map[string]Address
+}
+
+// NewFileLeaseStore creates a lease store backed by the file at the given path. The file is created on the first
+// stored lease if it does not exist.
+func NewFileLeaseStore(path string) *FileLeaseStore {
+	return &FileLeaseStore{path: path}
+}
+
+// WithLeaseStore sets the store used to persist address leases. Leases are loaded when the bus is created.
+func WithLeaseStore(s LeaseStore) Option {
+	return func(c *config) {
+		c.store = s
+	}
+}
+
+// Load implements the LeaseStore interface.
+func (f *FileLeaseStore) Load() (map[Udid]Address, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	leases := make(map[Udid]Address, len(f.leases))
+	for k, addr := range f.leases {
+		var id Udid
+		b, err := hex.DecodeString(k)
+		if err != nil || len(b) != len(id) {
+			return nil, fmt.Errorf("%s: invalid UDID %q", f.path, k)
+		}
+
+		copy(id[:], b)
+		leases[id] = addr
+	}
+
+	return leases, nil
+}
+
+// Store implements the LeaseStore interface.
+func (f *FileLeaseStore) Store(id Udid, addr Address) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	key := udidString(id)
+	for k, a := range f.leases {
+		if a == addr && k != key {
+			delete(f.leases, k)
+		}
+	}
+
+	f.leases[key] = addr
+
+	data, err := json.MarshalIndent(f.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file atomically
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// reads the file unless it has been read already
+func (f *FileLeaseStore) load() error {
+	if f.leases != nil {
+		return nil
+	}
+
+	f.leases = make(map[string]Address)
+
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &f.leases)
+	}
+
+	if err != nil {
+		f.leases = nil
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+
+	return nil
+}
+
+// leases tracks the addresses assigned to devices across bus resets and persists them in the lease store
+type leases struct {
+	store LeaseStore
+	addrs map[Udid]Address
+}
+
+// Loads leases from the store (which might be nil).
+func loadLeases(store LeaseStore) (*leases, error) {
+	l := &leases{store: store, addrs: make(map[Udid]Address)}
+
+	if store != nil {
+		addrs, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+
+		for id, addr := range addrs {
+			l.addrs[id] = addr
+		}
+	}
+
+	return l, nil
+}
+
+// Returns the address leased to the device.
+func (l *leases) addr(id Udid) (Address, bool) {
+	if l == nil {
+		return 0, false
+	}
+
+	addr, ok := l.addrs[id]
+	return addr, ok
+}
+
+// Reports whether the address is leased to another device.
+func (l *leases) leased(addr Address, id Udid) bool {
+	if l == nil {
+		return false
+	}
+
+	for k, a := range l.addrs {
+		if a == addr && k != id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Records the address assigned to the device.
+func (l *leases) update(id Udid, addr Address) error {
+	if l == nil {
+		return nil
+	}
+
+	if prev, ok := l.addrs[id]; ok && prev == addr {
+		return nil
+	}
+
+	for k, a := range l.addrs {
+		if a == addr {
+			delete(l.addrs, k)
+		}
+	}
+
+	l.addrs[id] = addr
+
+	if l.store != nil {
+		return l.store.Store(id, addr)
+	}
+
+	return nil
+}
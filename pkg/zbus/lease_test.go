@@ -0,0 +1,77 @@
+package zbus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileLeaseStore tests storing and loading of leases.
+func TestFileLeaseStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "leases.json")
+	id1 := Udid{0x01}
+	id2 := Udid{0x02}
+
+	f := NewFileLeaseStore(path)
+	if leases, err := f.Load(); err != nil || len(leases) != 0 {
+		t.Fatalf("Invalid leases of a missing file: %v, %v", leases, err)
+	}
+
+	for _, l := range []struct {
+		id   Udid
+		addr Address
+	}{{id1, 0x10}, {id2, 0x11}, {id1, 0x12}} {
+		if err := f.Store(l.id, l.addr); err != nil {
+			t.Fatalf("Failed to store lease: %v", err)
+		}
+	}
+
+	// the address of the 2nd device is taken over by the 1st one
+	if err := f.Store(id1, 0x11); err != nil {
+		t.Fatalf("Failed to store lease: %v", err)
+	}
+
+	leases, err := NewFileLeaseStore(path).Load()
+	if err != nil {
+		t.Fatalf("Failed to load leases: %v", err)
+	}
+
+	if len(leases) != 1 || leases[id1] != 0x11 {
+		t.Errorf("Invalid leases loaded: %v", leases)
+	}
+}
+
+// TestLeasedAddr tests that devices get their leased addresses back.
+func TestLeasedAddr(t *testing.T) {
+	id1 := Udid{0x01}
+	id2 := Udid{0x02}
+	id3 := Udid{0x03}
+
+	c := newConfig(nil)
+	c.leases = &leases{addrs: map[Udid]Address{id1: 0x15, id2: 0x10}}
+
+	a := newArp(&c)
+
+	// a new device must not take the address leased to another device
+	s3, _, err := a.register(&Device{Id: id3})
+	if err != nil || s3.addr != 0x11 {
+		t.Fatalf("Invalid address of a new device: %v, %v", s3, err)
+	}
+
+	s1, _, err := a.register(&Device{Id: id1})
+	if err != nil || s1.addr != 0x15 {
+		t.Fatalf("Leased address not assigned: %v, %v", s1, err)
+	}
+
+	s2, _, err := a.register(&Device{Id: id2})
+	if err != nil || s2.addr != 0x10 {
+		t.Fatalf("Leased address not assigned: %v, %v", s2, err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DebugLevel is used for detailed tracing of bus operations.
+	DebugLevel Level = iota
+
+	// InfoLevel is used for notable bus events.
+	InfoLevel
+
+	// WarnLevel is used for recoverable errors.
+	WarnLevel
+
+	// ErrorLevel is used for unrecoverable errors.
+	ErrorLevel
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Logger receives structured log messages from a bus. The keyvals hold alternating keys and values, e.g.
+// "addr", 0x10.
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// ParseLevel parses a level name as returned by Level.String.
+func ParseLevel(s string) (Level, error) {
+	for l := DebugLevel; l <= ErrorLevel; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// NewLogger creates a Logger that writes messages of at least the given level to l in the "msg key=value ..."
+// format. The standard logger of the log package is used if l is nil.
+func NewLogger(l *log.Logger, level Level) Logger {
+	return &textLogger{l, level}
+}
+
+// NewJSONLogger creates a Logger that writes messages of at least the given level to w as JSON objects, one per line.
+// The objects contain the "time", "level" and "msg" keys followed by the keyvals of the message.
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &jsonLogger{w: w, level: level}
+}
+
+// WithLogger sets the logger of the bus. By default, messages of InfoLevel and above are written to the standard
+// logger of the log package.
+func WithLogger(l Logger) Option {
+	return func(c *config) {
+		c.log = l
+	}
+}
+
+type textLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+func (t *textLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < t.level {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", keyvals[i], logValue(keyvals, i+1))
+	}
+
+	if t.l != nil {
+		_ = t.l.Output(2, sb.String())
+	} else {
+		_ = log.Output(2, sb.String())
+	}
+}
+
+type jsonLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+func (j *jsonLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < j.level {
+		return
+	}
+
+	// keep the order of keys stable by encoding the object manually
+	var sb strings.Builder
+	sb.WriteString("{")
+	writeJSON(&sb, "time", time.Now().Format(time.RFC3339Nano))
+	sb.WriteString(",")
+	writeJSON(&sb, "level", level.String())
+	sb.WriteString(",")
+	writeJSON(&sb, "msg", msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		sb.WriteString(",")
+		writeJSON(&sb, fmt.Sprint(keyvals[i]), logValue(keyvals, i+1))
+	}
+
+	sb.WriteString("}\n")
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, _ = io.WriteString(j.w, sb.String())
+}
+
+func writeJSON(sb *strings.Builder, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	sb.Write(k)
+	sb.WriteString(":")
+	sb.Write(v)
+}
+
+// Returns the i-th value of keyvals in a loggable form.
+func logValue(keyvals []interface{}, i int) interface{} {
+	if i >= len(keyvals) {
+		return "MISSING"
+	}
+
+	switch v := keyvals[i].(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// Logs the bus event.
+func logEvent(l Logger, ev Event) {
+	kv := []interface{}{"event", ev.Type}
+	if ev.Addr != 0 {
+		kv = append(kv, "addr", addrString(ev.Addr))
+	}
+
+	if ev.Dev != nil {
+		kv = append(kv, "udid", udidString(ev.Dev.Id), "priority", ev.Dev.Priority)
+	}
+
+	switch ev.Type {
+	case PacketEvent:
+		kv = append(kv, "addr", addrString(ev.Pkt.Addr), "len", len(ev.Pkt.Data))
+		l.Log(DebugLevel, "packet received", kv...)
+
+	case ErrorEvent:
+		kv = append(kv, "type", ev.Err, "err", ev.Cause)
+		if ev.Err == SysError {
+			l.Log(ErrorLevel, "bus error", kv...)
+		} else {
+			l.Log(WarnLevel, "bus error", kv...)
+		}
+
+	case ConnectEvent:
+		l.Log(InfoLevel, "slave connected", kv...)
+
+	case DisconnectEvent:
+		l.Log(InfoLevel, "slave disconnected", kv...)
+
+	case ReregisterEvent:
+		l.Log(InfoLevel, "slave re-registered", kv...)
+
+	default:
+		l.Log(DebugLevel, "bus event", kv...)
+	}
+}
+
+// Formats the UDID for logging.
+func udidString(id Udid) string {
+	return hex.EncodeToString(id[:])
+}
+
+// Formats the address for logging.
+func addrString(addr Address) string {
+	return fmt.Sprintf("%02X", addr)
+}
@@ -0,0 +1,53 @@
+package zbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+// TestLogger tests the text logger output and level filtering.
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(log.New(&buf, "", 0), InfoLevel)
+
+	l.Log(DebugLevel, "filtered")
+	l.Log(InfoLevel, "slave connected", "addr", addrString(0x10), "udid", udidString(Udid{0x01}))
+
+	if s := buf.String(); s != "slave connected addr=10 udid=0100000000000000\n" {
+		t.Errorf("Invalid log output %q", s)
+	}
+}
+
+// TestJSONLogger tests that the JSON logger writes one valid JSON object per message.
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf, DebugLevel)
+
+	logEvent(l, errorEvent(AckError, 0x12, ErrNoSlave))
+	logEvent(l, Event{Type: ConnectEvent, Addr: 0x10, Dev: &Device{Id: Udid{0x01}}})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Invalid number of log lines: %v", len(lines))
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", lines[0], err)
+	}
+
+	if m["level"] != "warn" || m["event"] != "error" || m["addr"] != "12" || m["type"] != "ack" {
+		t.Errorf("Invalid error event log %q", lines[0])
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", lines[1], err)
+	}
+
+	if m["level"] != "info" || m["event"] != "connect" || m["udid"] != "0100000000000000" {
+		t.Errorf("Invalid connect event log %q", lines[1])
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Option configures a bus instance.
+type Option func(*config)
+
+// bus configuration
+type config struct {
+	discovery time.Duration
+	silence   time.Duration
+	events    int
+	minAddr   Address
+	maxAddr   Address
+	maxSlaves int
+	crc       bool
+	retry     RetryPolicy
+	addrRetry map[Address]RetryPolicy
+	log       Logger
+	store     LeaseStore
+	leases    *leases
+	policy    *Policy
+	rereg     Reregistration
+	overflow  Overflow
+}
+
+const (
+	// Reconnect handles a re-registered slave as a new one: a DisconnectEvent is emitted for its previous address
+	// followed by a ConnectEvent for the newly assigned address.
+	Reconnect Reregistration = iota
+
+	// KeepAddress assigns the re-registered slave its previous address and emits a ReregisterEvent.
+	KeepAddress
+)
+
+// Reregistration determines how a slave that registers again while being registered (e.g. after its reboot) is
+// handled.
+type Reregistration int
+
+// RetryPolicy determines how I2C transactions that are not acknowledged are retried. The zero value disables retries.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts including the first one.
+	Attempts int
+
+	// Backoff is the delay before the first retry. The delay doubles with every following retry.
+	Backoff time.Duration
+
+	// MaxBackoff limits the delay between retries. Zero means no limit.
+	MaxBackoff time.Duration
+}
+
+func newConfig(opts []Option) config {
+	c := config{
+		discovery: time.Second,
+		silence:   silenceLimit,
+		events:    EventCapacity,
+		minAddr:   minAddr,
+		maxAddr:   maxAddr,
+		maxSlaves: MaxSlaves,
+		log:       NewLogger(nil, InfoLevel),
+	}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
+// Validates the configuration and loads address leases.
+func (c *config) setup() error {
+	if err := c.check(); err != nil {
+		return err
+	}
+
+	var err error
+	c.leases, err = loadLeases(c.store)
+
+	return err
+}
+
+// Validates the configuration.
+func (c *config) check() error {
+	if c.discovery <= 0 {
+		return errors.New("invalid discovery interval")
+	}
+
+	if c.silence <= 0 {
+		return errors.New("invalid silence timeout")
+	}
+
+	if c.events < 1 {
+		return errors.New("invalid event capacity")
+	}
+
+	// the address space must not overlap reserved I2C addresses and the zen-bus broadcast addresses
+	if c.minAddr < 0x08 || c.maxAddr > ConfAddr || c.minAddr >= c.maxAddr {
+		return errors.New("invalid slave address range")
+	}
+
+	if c.maxSlaves < 1 || c.maxSlaves > int(c.maxAddr-c.minAddr) {
+		return errors.New("invalid slave limit")
+	}
+
+	if c.log == nil {
+		return errors.New("missing logger")
+	}
+
+	if c.overflow < Block || c.overflow > Coalesce {
+		return errors.New("invalid overflow policy")
+	}
+
+	if c.rereg != Reconnect && c.rereg != KeepAddress {
+		return errors.New("invalid re-registration mode")
+	}
+
+	if err := c.policy.check(c.minAddr, c.maxAddr); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WithDiscoveryInterval sets the interval of discovering new slaves and pinging silent ones. The default interval is
+// one second.
+func WithDiscoveryInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.discovery = d
+	}
+}
+
+// WithSilenceTimeout sets the time after which a silent slave is pinged. The default timeout is five seconds.
+func WithSilenceTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.silence = d
+	}
+}
+
+// WithEventCapacity sets the size of the Events channel and of subscriber channels. The default size is
+// EventCapacity, the size must be at least 1.
+func WithEventCapacity(n int) Option {
+	return func(c *config) {
+		c.events = n
+	}
+}
+
+// WithAddrRange sets the range of addresses assigned to slaves, min is inclusive and max is exclusive. The default
+// range is 0x10-0x50. The range must lie between 0x08 and ConfAddr.
+func WithAddrRange(min, max Address) Option {
+	return func(c *config) {
+		c.minAddr = min
+		c.maxAddr = max
+	}
+}
+
+// WithMaxSlaves sets the maximum number of connected slaves. The default limit is MaxSlaves. The limit also bounds
+// the number of packets polled in a row while the alert signal is active.
+func WithMaxSlaves(n int) Option {
+	return func(c *config) {
+		c.maxSlaves = n
+	}
+}
+
+// WithCRC enables CRC protection of packets. A CRC-8 trailer computed the same way as the SMBus PEC is appended to
+// the poll header and to packet data in both directions. Slaves must be configured accordingly.
+func WithCRC() Option {
+	return func(c *config) {
+		c.crc = true
+	}
+}
+
+// WithRetry sets the default retry policy of the bus. The policy applies to sending packets, reading polled packets
+// and configuring newly discovered slaves. Retries are scheduled, the bus keeps serving other slaves in the meantime
+// while packets to the same slave keep their order.
+func WithRetry(p RetryPolicy) Option {
+	return func(c *config) {
+		c.retry = p
+	}
+}
+
+// WithAddrRetry sets the retry policy for transactions with the slave at the given address. It takes precedence
+// over the default retry policy.
+func WithAddrRetry(addr Address, p RetryPolicy) Option {
+	return func(c *config) {
+		if c.addrRetry == nil {
+			c.addrRetry = make(map[Address]RetryPolicy)
+		}
+		c.addrRetry[addr] = p
+	}
+}
+
+// WithReregistration sets how slaves that register again are handled. The default is Reconnect.
+func WithReregistration(r Reregistration) Option {
+	return func(c *config) {
+		c.rereg = r
+	}
+}
+
+// Returns the retry policy for the address.
+func (c *config) retryPolicy(addr Address) RetryPolicy {
+	if p, ok := c.addrRetry[addr]; ok {
+		return p
+	}
+	return c.retry
+}
+
+// Delay returns the delay before the n-th retry (starting with 1).
+func (p RetryPolicy) Delay(n int) time.Duration {
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = math.MaxInt64
+	}
+
+	d := p.Backoff
+	for i := 1; i < n && d > 0 && d < max; i++ {
+		if d > max/2 {
+			// doubling would exceed the limit or overflow
+			d = max
+			break
+		}
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d
+}
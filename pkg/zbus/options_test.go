@@ -0,0 +1,53 @@
+package zbus
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestRetryDelay tests the backoff schedule of a retry policy.
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 10, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	for n, d := range []time.Duration{10, 20, 40, 50, 50} {
+		if p.Delay(n+1) != d*time.Millisecond {
+			t.Errorf("Invalid delay of retry %v: %v", n+1, p.Delay(n+1))
+		}
+	}
+
+	// the delay does not overflow without a limit
+	p = RetryPolicy{Attempts: 100, Backoff: time.Second}
+	if d := p.Delay(100); d != math.MaxInt64 {
+		t.Errorf("Invalid unlimited delay: %v", d)
+	}
+}
+
+// TestConfigCheck tests validation of bus options.
+func TestConfigCheck(t *testing.T) {
+	if c := newConfig(nil); c.check() != nil {
+		t.Errorf("Default configuration is invalid")
+	}
+
+	invalid := [][]Option{
+		{WithDiscoveryInterval(0)},
+		{WithSilenceTimeout(-time.Second)},
+		{WithEventCapacity(-1)},
+		{WithEventCapacity(0)},
+		{WithAddrRange(0x00, 0x50)},
+		{WithAddrRange(0x10, 0x78)},
+		{WithAddrRange(0x30, 0x20)},
+		{WithMaxSlaves(0)},
+		{WithAddrRange(0x10, 0x14), WithMaxSlaves(5)},
+	}
+
+	for i, opts := range invalid {
+		if c := newConfig(opts); c.check() == nil {
+			t.Errorf("Invalid configuration %v accepted", i)
+		}
+	}
+	// a dispatcher falls back to the default capacity
+	if d := NewDispatcher(WithEventCapacity(0)); cap(d.Events()) != EventCapacity {
+		t.Errorf("Invalid event capacity %v", cap(d.Events()))
+	}
+}
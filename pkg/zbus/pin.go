@@ -0,0 +1,94 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const chipPrefix = "gpiochip"
+
+// AlertPin identifies the GPIO line that carries the bus alert signal.
+type AlertPin struct {
+	// Chip is the number of the GPIO character device (/dev/gpiochipN).
+	Chip int
+
+	// Line is the line offset within the chip, or the global GPIO number if Sysfs is set.
+	Line int
+
+	// Sysfs selects the deprecated /sys/class/gpio interface instead of the GPIO character device.
+	Sysfs bool
+}
+
+// ParseAlertPin parses an alert pin specification. The "gpiochipN:L" form selects the line L of the GPIO character
+// device /dev/gpiochipN, a plain number selects a pin of the deprecated sysfs GPIO interface.
+func ParseAlertPin(s string) (AlertPin, error) {
+	if !strings.HasPrefix(s, chipPrefix) {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return AlertPin{}, fmt.Errorf("invalid GPIO pin %q", s)
+		}
+
+		return AlertPin{Line: n, Sysfs: true}, nil
+	}
+
+	parts := strings.SplitN(s[len(chipPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return AlertPin{}, fmt.Errorf("invalid GPIO line %q", s)
+	}
+
+	chip, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return AlertPin{}, fmt.Errorf("invalid GPIO chip in %q", s)
+	}
+
+	line, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return AlertPin{}, fmt.Errorf("invalid GPIO line in %q", s)
+	}
+
+	return AlertPin{Chip: chip, Line: line}, nil
+}
+
+// String returns the pin specification in the format accepted by ParseAlertPin.
+func (p AlertPin) String() string {
+	if p.Sysfs {
+		return strconv.Itoa(p.Line)
+	}
+
+	return fmt.Sprintf("%s%d:%d", chipPrefix, p.Chip, p.Line)
+}
+
+func (p AlertPin) check() error {
+	if p.Sysfs {
+		if p.Line < 0 || p.Line > MaxPin {
+			return errors.New("invalid GPIO pin index")
+		}
+		return nil
+	}
+
+	if p.Chip < 0 || p.Chip > MaxGpioChip {
+		return errors.New("invalid GPIO chip index")
+	}
+
+	if p.Line < 0 || p.Line > MaxPin {
+		return errors.New("invalid GPIO line offset")
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package zbus
+
+import "testing"
+
+// TestParseAlertPin tests parsing of alert pin specifications.
+func TestParseAlertPin(t *testing.T) {
+	valid := map[string]AlertPin{
+		"17":            {Line: 17, Sysfs: true},
+		"gpiochip0:17":  {Chip: 0, Line: 17},
+		"gpiochip12:3":  {Chip: 12, Line: 3},
+		"gpiochip1:999": {Chip: 1, Line: 999},
+	}
+
+	for s, want := range valid {
+		pin, err := ParseAlertPin(s)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", s, err)
+			continue
+		}
+
+		if pin != want {
+			t.Errorf("Invalid pin parsed from %q: %+v", s, pin)
+		}
+
+		if pin.String() != s {
+			t.Errorf("Invalid pin string %q, %q expected", pin.String(), s)
+		}
+	}
+
+	for _, s := range []string{"", "x", "gpiochip", "gpiochip0", "gpiochip0:", "gpiochipX:1", "gpiochip0:y"} {
+		if _, err := ParseAlertPin(s); err == nil {
+			t.Errorf("Invalid pin %q parsed successfully", s)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrDenied is the cause of a RegError when the device matches the deny list of the registration policy.
+	ErrDenied = errors.New("device denied")
+
+	// ErrNotAllowed is the cause of a RegError when the device does not match the allow list of the registration
+	// policy.
+	ErrNotAllowed = errors.New("device not allowed")
+
+	// ErrReserved is the cause of a RegError when the address reserved for the device is not available.
+	ErrReserved = errors.New("reserved address not available")
+)
+
+const (
+	// LowPriority slaves get the highest free addresses and are serviced last.
+	LowPriority Priority = iota - 1
+
+	// NormalPriority is the default priority of slaves.
+	NormalPriority
+
+	// HighPriority slaves get the lowest free addresses and are serviced first, even when the bus is congested.
+	HighPriority
+)
+
+// number of the lowest addresses kept free for high priority slaves if possible
+const highBand = 8
+
+// Priority is the priority class of a slave. Slaves of higher priority get lower addresses, which win the arbitration
+// of the poll transaction, are pinged first and keep being polled when the alert limit has been reached.
+type Priority int
+
+// String returns the name of the priority.
+func (p Priority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case NormalPriority:
+		return "normal"
+	case HighPriority:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+// Policy restricts which devices may register on the bus and which addresses they get.
+type Policy struct {
+	// Reserved maps addresses to the devices they are reserved for. A device with a reservation always gets the
+	// reserved address, other devices never get it.
+	Reserved map[Address]Udid
+
+	// Allow lists UDID prefixes of devices that may register. All devices are allowed if the list is empty.
+	Allow [][]byte
+
+	// Deny lists UDID prefixes of devices that may not register. It takes precedence over the allow list.
+	Deny [][]byte
+
+	// High lists UDID prefixes of high priority devices. If not empty, the lowest addresses are kept free for high
+	// priority devices as long as other addresses are available.
+	High [][]byte
+
+	// Low lists UDID prefixes of low priority devices.
+	Low [][]byte
+}
+
+// WithPolicy sets the registration policy of the bus. Devices rejected by the policy are reported by RegError events
+// with the cause matching ErrDenied, ErrNotAllowed or ErrReserved and parked at ParkAddr. The bus keeps its own copy of
+// the policy.
+func WithPolicy(p Policy) Option {
+	return func(c *config) {
+		c.policy = p.clone()
+	}
+}
+
+// Returns a deep copy of the policy.
+func (p *Policy) clone() *Policy {
+	c := &Policy{
+		Allow: clonePrefixes(p.Allow),
+		Deny:  clonePrefixes(p.Deny),
+		High:  clonePrefixes(p.High),
+		Low:   clonePrefixes(p.Low),
+	}
+
+	if p.Reserved != nil {
+		c.Reserved = make(map[Address]Udid, len(p.Reserved))
+		for addr, id := range p.Reserved {
+			c.Reserved[addr] = id
+		}
+	}
+
+	return c
+}
+
+// Validates the policy against the address range.
+func (p *Policy) check(min, max Address) error {
+	if p == nil {
+		return nil
+	}
+
+	ids := make(map[Udid]bool)
+	for addr, id := range p.Reserved {
+		if addr < min || addr >= max {
+			return fmt.Errorf("reserved address %02X out of range", addr)
+		}
+
+		if ids[id] {
+			return fmt.Errorf("multiple addresses reserved for device %s", udidString(id))
+		}
+		ids[id] = true
+	}
+
+	return nil
+}
+
+// Checks whether the device may register.
+func (p *Policy) admit(id Udid) error {
+	if p == nil {
+		return nil
+	}
+
+	if matchPrefix(p.Deny, id) {
+		return fmt.Errorf("%s: %w", udidString(id), ErrDenied)
+	}
+
+	if len(p.Allow) > 0 && !matchPrefix(p.Allow, id) {
+		return fmt.Errorf("%s: %w", udidString(id), ErrNotAllowed)
+	}
+
+	return nil
+}
+
+// Returns the priority of the device, the UDID prefixes of the policy take precedence over the device descriptor.
+func (p *Policy) priority(dev *Device) Priority {
+	switch {
+	case p == nil:
+		return dev.Priority
+	case matchPrefix(p.High, dev.Id):
+		return HighPriority
+	case matchPrefix(p.Low, dev.Id):
+		return LowPriority
+	default:
+		return dev.Priority
+	}
+}
+
+// Returns the address reserved for the device.
+func (p *Policy) reservation(id Udid) (Address, bool) {
+	if p == nil {
+		return 0, false
+	}
+
+	for addr, x := range p.Reserved {
+		if x == id {
+			return addr, true
+		}
+	}
+
+	return 0, false
+}
+
+// Reports whether the address is reserved for another device.
+func (p *Policy) reserved(addr Address, id Udid) bool {
+	if p == nil {
+		return false
+	}
+
+	x, ok := p.Reserved[addr]
+	return ok && x != id
+}
+
+func clonePrefixes(prefixes [][]byte) [][]byte {
+	if prefixes == nil {
+		return nil
+	}
+
+	c := make([][]byte, len(prefixes))
+	for i, prefix := range prefixes {
+		c[i] = append([]byte(nil), prefix...)
+	}
+	return c
+}
+
+func matchPrefix(prefixes [][]byte, id Udid) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(id[:], prefix) {
+			return true
+		}
+	}
+	return false
+}
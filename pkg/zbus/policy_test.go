@@ -0,0 +1,102 @@
+package zbus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestPolicy tests address reservations and allow and deny lists.
+func TestPolicy(t *testing.T) {
+	reserved := Udid{0x01, 0x01}
+	c := newConfig([]Option{WithPolicy(Policy{
+		Reserved: map[Address]Udid{0x10: reserved},
+		Allow:    [][]byte{{0x01}},
+		Deny:     [][]byte{{0x01, 0xFF}},
+	})})
+	if err := c.check(); err != nil {
+		t.Fatalf("Invalid configuration: %v", err)
+	}
+
+	a := newArp(&c)
+
+	// the reserved address is not given to other devices
+	s, _, err := a.register(&Device{Id: Udid{0x01, 0x02}})
+	if err != nil || s.addr != 0x11 {
+		t.Fatalf("Device registered with address %v, %v", s, err)
+	}
+
+	s, _, err = a.register(&Device{Id: reserved})
+	if err != nil || s.addr != 0x10 {
+		t.Fatalf("Reserved address not assigned: %v, %v", s, err)
+	}
+
+	if _, _, err := a.register(&Device{Id: Udid{0x02}}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("ErrNotAllowed expected, got %v", err)
+	}
+
+	if _, _, err := a.register(&Device{Id: Udid{0x01, 0xFF}}); !errors.Is(err, ErrDenied) {
+		t.Errorf("ErrDenied expected, got %v", err)
+	}
+
+	if a.num != 2 {
+		t.Errorf("Invalid number of registered devices, 2 expected, got %v", a.num)
+	}
+
+	// the bus does not share the policy with the caller
+	p := Policy{Reserved: map[Address]Udid{0x10: reserved}, Deny: [][]byte{{0x01}}}
+	c = newConfig([]Option{WithPolicy(p)})
+	p.Reserved[0x11] = reserved
+	p.Deny[0][0] = 0x02
+
+	if len(c.policy.Reserved) != 1 || c.policy.Deny[0][0] != 0x01 {
+		t.Errorf("Policy shared with the caller: %+v", c.policy)
+	}
+
+	// invalid reservations
+	for _, p := range []Policy{
+		{Reserved: map[Address]Udid{0x60: reserved}},
+		{Reserved: map[Address]Udid{0x10: reserved, 0x11: reserved}},
+	} {
+		c := newConfig([]Option{WithPolicy(p)})
+		if err := c.check(); err == nil {
+			t.Errorf("Invalid policy accepted: %+v", p)
+		}
+	}
+}
+
+// TestPriority tests address assignment according to priority classes.
+func TestPriority(t *testing.T) {
+	c := newConfig([]Option{WithPolicy(Policy{
+		High: [][]byte{{0x01}},
+		Low:  [][]byte{{0x02}},
+	})})
+	a := newArp(&c)
+
+	for _, x := range []struct {
+		id   Udid
+		addr Address
+		prio Priority
+	}{
+		{Udid{0x03}, 0x18, NormalPriority},
+		{Udid{0x01}, 0x10, HighPriority},
+		{Udid{0x02}, 0x4F, LowPriority},
+		{Udid{0x01, 0x01}, 0x11, HighPriority},
+	} {
+		dev := Device{Id: x.id}
+		s, _, err := a.register(&dev)
+		if err != nil || s.addr != x.addr || s.prio != x.prio || dev.Priority != x.prio {
+			t.Fatalf("Device %x registered with address %v, priority %v, %v", x.id, s, dev.Priority, err)
+		}
+	}
+
+	// higher priority first, then by address
+	var addrs []Address
+	for _, s := range a.byPriority() {
+		addrs = append(addrs, s.addr)
+	}
+
+	if !bytes.Equal(addrs, []Address{0x10, 0x11, 0x18, 0x4F}) {
+		t.Errorf("Invalid order of slaves: %x", addrs)
+	}
+}
@@ -0,0 +1,494 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package reliable implements end-to-end acknowledged delivery of messages on top of a zbus.Bus.
+
+Every packet starts with a two byte header: the message type (data or acknowledgement) and a sequence number. Each
+data message is acknowledged by the receiver with an acknowledgement carrying the same sequence number, a message
+that is not acknowledged in time is retransmitted. Messages are delivered to every peer one at a time in the order
+they were sent. The receiver suppresses duplicates caused by lost acknowledgements by remembering the sequence number
+of the last delivered message. Slaves must implement the same protocol.
+*/
+package reliable
+
+import (
+	"context"
+	"errors"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/wrap"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize = 2 // size of the message header
+
+	msgData uint8 = 0x00 // data message
+	msgAck  uint8 = 0x01 // acknowledgement of a data message
+
+	// MaxMessageSize is the maximum size of a message sent over a bus with packets limited to zbus.MaxPacketSize.
+	MaxMessageSize = zbus.MaxPacketSize - headerSize
+)
+
+var (
+	// ErrTimeout is the cause of an AckError event (or the error returned by SendSync) reporting a message that has
+	// not been acknowledged by the peer.
+	ErrTimeout = errors.New("message not acknowledged")
+
+	// ErrTooLarge is returned when sending a message larger than MaxMessageSize.
+	ErrTooLarge = errors.New("message too large")
+
+	// DefaultRetry is the default retransmission policy.
+	DefaultRetry = zbus.RetryPolicy{Attempts: 5, Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+)
+
+// Bus is a zbus.Bus that delivers messages reliably. Incoming messages are reported by PacketEvents, all other events
+// of the underlying bus are passed through. Messages waiting for delivery fail when the bus is reset.
+type Bus struct {
+	base
+	bus    zbus.Bus
+	loop   *wrap.Loop
+	stop   chan struct{}
+	term   chan struct{}
+	retry  zbus.RetryPolicy
+	once   sync.Once
+	events []zbus.Option // options of the event dispatcher
+	ctx    context.Context
+	cancel func() // abandons the packets being sent to the underlying bus
+
+	peers map[zbus.Address]*peer
+	idle  []chan struct{} // closed once all queued messages are delivered
+}
+
+// base passes the methods of zbus.Bus that need no acknowledgements through to the underlying bus
+type base = wrap.Base
+
+// Option configures a Bus.
+type Option func(*Bus)
+
+// state of the communication with a peer
+type peer struct {
+	seq     uint8      // sequence number of the next outgoing message
+	queue   []*message // outgoing messages, the first one is in flight
+	last    uint8      // sequence number of the last delivered incoming message
+	hasLast bool
+	out     *sender
+}
+
+// sender passes the packets to a peer to the underlying bus one by one, so that they keep their order and the event
+// loop is not blocked by the underlying bus
+type sender struct {
+	mu      sync.Mutex
+	packets []outgoing
+	signal  chan struct{} // ready while there are packets
+	done    chan struct{} // closed when the peer is dropped
+}
+
+// an outgoing packet
+type outgoing struct {
+	pkt zbus.Packet
+	m   *message // the transmitted message, nil for acknowledgements
+}
+
+// an outgoing message
+type message struct {
+	pkt      zbus.Packet
+	res      chan error // nil if the sender does not wait for the result
+	seq      uint8
+	attempts int
+	deadline time.Time
+}
+
+// WithRetry sets the retransmission policy. Attempts limits the number of transmissions of a message, Backoff and
+// MaxBackoff determine the time of waiting for an acknowledgement. The default policy is DefaultRetry.
+func WithRetry(p zbus.RetryPolicy) Option {
+	return func(r *Bus) {
+		if p.Attempts > 0 && p.Backoff > 0 {
+			r.retry = p
+		}
+	}
+}
+
+// WithEvents configures the Events channel and subscriptions of the bus by the zbus.WithEventCapacity,
+// zbus.WithOverflow and zbus.WithLogger options, other options are ignored. The defaults are those of zbus, not the
+// configuration of the underlying bus, so the options it was created with are usually passed here as well.
+func WithEvents(opts ...zbus.Option) Option {
+	return func(r *Bus) {
+		r.events = append(r.events, opts...)
+	}
+}
+
+// New creates a reliable bus on top of the given bus. The returned bus takes over the events of the underlying one,
+// which must not be used directly anymore.
+func New(b zbus.Bus, opts ...Option) *Bus {
+	r := &Bus{
+		bus:   b,
+		stop:  make(chan struct{}),
+		term:  make(chan struct{}),
+		retry: DefaultRetry,
+		peers: make(map[zbus.Address]*peer),
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.base, r.loop = wrap.New(b, r.events...)
+
+	go r.processEvents()
+
+	return r
+}
+
+// Shutdown stops accepting messages, waits until the queued messages are delivered (or their delivery fails) and then
+// shuts down the underlying bus gracefully.
+func (r *Bus) Shutdown(ctx context.Context) error {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+
+	idle := make(chan struct{})
+
+	queued := r.loop.Post(func() {
+		r.idle = append(r.idle, idle)
+	})
+	if !queued {
+		close(idle)
+	}
+
+	select {
+	case <-idle:
+		break
+	case <-r.term:
+		break
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return r.bus.Shutdown(ctx)
+}
+
+// Close closes the bus and the underlying bus, the packets being sent are abandoned.
+func (r *Bus) Close() {
+	r.cancel()
+	r.base.Close()
+}
+
+// Send queues a message of up to MaxMessageSize bytes for delivery. Failures are reported by AckError events. Messages
+// sent once the bus is shutting down are dropped.
+func (r *Bus) Send(pkt zbus.Packet) {
+	if r.stopped() {
+		return
+	}
+
+	if len(pkt.Data) > MaxMessageSize {
+		r.loop.Report((&zbus.Error{Type: zbus.AckError, Addr: pkt.Addr, Err: ErrTooLarge}).Event())
+		return
+	}
+
+	r.queue(&message{pkt: pkt})
+}
+
+// SendSync sends a message of up to MaxMessageSize bytes and waits until it is acknowledged by the peer. It returns an
+// error matching ErrTimeout if the peer does not acknowledge the message, ErrTooLarge if the message is too large,
+// zbus.ErrNoSlave if the peer is not connected and zbus.ErrClosed if the bus is closed. Other errors of the underlying
+// bus are returned as well, only unacknowledged packets are retransmitted. Cancelling the context stops waiting for
+// the result, not the delivery.
+func (r *Bus) SendSync(ctx context.Context, pkt zbus.Packet) error {
+	if r.stopped() {
+		return zbus.ErrClosed
+	}
+
+	if len(pkt.Data) > MaxMessageSize {
+		return ErrTooLarge
+	}
+
+	m := &message{pkt: pkt, res: make(chan error, 1)}
+	if !r.queue(m) {
+		return zbus.ErrClosed
+	}
+
+	select {
+	case err := <-m.res:
+		return err
+	case <-r.term:
+		// the result might have been reported before the termination
+		select {
+		case err := <-m.res:
+			return err
+		default:
+			return zbus.ErrClosed
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Bus) processEvents() {
+	tick := r.retry.Backoff / 4
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+
+	ticker := time.NewTicker(tick)
+
+	defer func() {
+		ticker.Stop()
+		for addr := range r.peers {
+			r.drop(addr, zbus.ErrClosed)
+		}
+		r.cancel()
+		r.loop.Close()
+		close(r.term)
+	}()
+
+	for {
+		select {
+		case ev, ok := <-r.bus.Events():
+			if !ok {
+				return
+			}
+
+			r.process(ev)
+
+		case <-r.loop.Posted():
+			r.loop.Run()
+
+		case now := <-ticker.C:
+			// retransmit messages that have not been acknowledged in time
+			for addr, p := range r.peers {
+				if len(p.queue) == 0 || now.Before(p.queue[0].deadline) {
+					continue
+				}
+
+				if m := p.queue[0]; m.attempts < r.retry.Attempts {
+					r.transmit(m)
+				} else {
+					r.complete(addr, ErrTimeout)
+				}
+			}
+		}
+
+		r.notifyIdle()
+	}
+}
+
+// passes the message to the event loop without waiting for it, reports whether the message has been accepted
+func (r *Bus) queue(m *message) bool {
+	return r.loop.Post(func() {
+		p := r.peer(m.pkt.Addr)
+		m.seq = p.seq
+		p.seq++
+
+		p.queue = append(p.queue, m)
+		if len(p.queue) == 1 {
+			r.transmit(m)
+		}
+	})
+}
+
+// reports whether the bus is shutting down
+func (r *Bus) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// lets the waiting Shutdown calls know that all queued messages have been delivered
+func (r *Bus) notifyIdle() {
+	if len(r.idle) == 0 {
+		return
+	}
+
+	for _, p := range r.peers {
+		if len(p.queue) > 0 {
+			return
+		}
+	}
+
+	for _, idle := range r.idle {
+		close(idle)
+	}
+	r.idle = nil
+}
+
+func (r *Bus) process(ev zbus.Event) {
+	switch ev.Type {
+	case zbus.PacketEvent:
+		r.receive(ev.Pkt)
+		return
+
+	case zbus.ResetEvent:
+		for addr := range r.peers {
+			r.drop(addr, zbus.ErrNoSlave)
+		}
+
+	case zbus.DisconnectEvent, zbus.ReregisterEvent:
+		r.drop(ev.Addr, zbus.ErrNoSlave)
+	}
+
+	r.loop.Emit(ev)
+}
+
+func (r *Bus) receive(pkt *zbus.Packet) {
+	if len(pkt.Data) < headerSize {
+		r.loop.Emit((&zbus.Error{Type: zbus.BusError, Addr: pkt.Addr, Err: errors.New("invalid message header")}).Event())
+		return
+	}
+
+	typ, seq := pkt.Data[0], pkt.Data[1]
+
+	switch typ {
+	case msgAck:
+		if p := r.peers[pkt.Addr]; p != nil && len(p.queue) > 0 && p.queue[0].seq == seq {
+			r.complete(pkt.Addr, nil)
+		}
+
+	case msgData:
+		// acknowledge the message, even a duplicate one as the previous acknowledgement might have been lost
+		r.send(zbus.Packet{Addr: pkt.Addr, Data: []byte{msgAck, seq}}, nil)
+
+		p := r.peer(pkt.Addr)
+		if p.hasLast && p.last == seq {
+			return
+		}
+
+		p.last = seq
+		p.hasLast = true
+
+		r.loop.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &zbus.Packet{Addr: pkt.Addr, Data: pkt.Data[headerSize:]}})
+
+	default:
+		r.loop.Emit((&zbus.Error{Type: zbus.BusError, Addr: pkt.Addr, Err: errors.New("invalid message type")}).Event())
+	}
+}
+
+// (re)transmits the message
+func (r *Bus) transmit(m *message) {
+	m.attempts++
+	m.deadline = time.Now().Add(r.retry.Delay(m.attempts))
+
+	data := make([]byte, headerSize, headerSize+len(m.pkt.Data))
+	data[0] = msgData
+	data[1] = m.seq
+
+	r.send(zbus.Packet{Addr: m.pkt.Addr, Data: append(data, m.pkt.Data...)}, m)
+}
+
+// queues the packet for the sender of the peer
+func (r *Bus) send(pkt zbus.Packet, m *message) {
+	out := r.peer(pkt.Addr).out
+
+	out.mu.Lock()
+	out.packets = append(out.packets, outgoing{pkt, m})
+	out.mu.Unlock()
+
+	select {
+	case out.signal <- struct{}{}:
+	default:
+		// the sender has already been signalled
+	}
+}
+
+// sends the packets queued for the peer until it is dropped or the bus is closed
+func (r *Bus) processOutput(out *sender) {
+	for {
+		select {
+		case <-out.signal:
+			break
+		case <-out.done:
+			return
+		case <-r.ctx.Done():
+			return
+		}
+
+		out.mu.Lock()
+		packets := out.packets
+		out.packets = nil
+		out.mu.Unlock()
+
+		for _, o := range packets {
+			r.deliver(o)
+		}
+	}
+}
+
+// passes the packet to the underlying bus, a failed transmission of a message completes it
+func (r *Bus) deliver(o outgoing) {
+	err := r.bus.SendSync(r.ctx, o.pkt)
+	if o.m == nil || err == nil || errors.Is(err, zbus.ErrAck) || r.ctx.Err() != nil {
+		// lost packets are retransmitted, other failures are permanent
+		return
+	}
+
+	r.loop.Post(func() {
+		if p := r.peers[o.pkt.Addr]; p != nil && len(p.queue) > 0 && p.queue[0] == o.m {
+			r.complete(o.pkt.Addr, err)
+		}
+	})
+}
+
+// completes the message in flight and transmits the next one
+func (r *Bus) complete(addr zbus.Address, err error) {
+	p := r.peers[addr]
+	m := p.queue[0]
+	p.queue = p.queue[1:]
+
+	r.result(m, err)
+
+	if len(p.queue) > 0 {
+		r.transmit(p.queue[0])
+	}
+}
+
+// fails all outgoing messages to the peer and forgets it
+func (r *Bus) drop(addr zbus.Address, err error) {
+	p := r.peers[addr]
+	if p == nil {
+		return
+	}
+
+	delete(r.peers, addr)
+	close(p.out.done)
+
+	for _, m := range p.queue {
+		r.result(m, err)
+	}
+}
+
+// reports the result of the delivery to the sender
+func (r *Bus) result(m *message, err error) {
+	if m.res != nil {
+		m.res <- err
+	} else if err != nil && err != zbus.ErrClosed {
+		r.loop.Emit((&zbus.Error{Type: zbus.AckError, Addr: m.pkt.Addr, Err: err}).Event())
+	}
+}
+
+func (r *Bus) peer(addr zbus.Address) *peer {
+	p := r.peers[addr]
+	if p == nil {
+		p = &peer{out: &sender{signal: make(chan struct{}, 1), done: make(chan struct{})}}
+		r.peers[addr] = p
+
+		go r.processOutput(p.out)
+	}
+	return p
+}
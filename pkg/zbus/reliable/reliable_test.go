@@ -0,0 +1,267 @@
+package reliable
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/bustest"
+	"github.com/omSquare/zen-bus/pkg/zbus/simslave"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDelivery tests acknowledged delivery and retransmission of messages.
+func TestDelivery(t *testing.T) {
+	b := bustest.New()
+	r := New(b, WithRetry(zbus.RetryPolicy{Attempts: 2, Backoff: 10 * time.Millisecond}))
+	defer r.Close()
+
+	res := make(chan error)
+	go func() {
+		res <- r.SendSync(context.Background(), zbus.Packet{Addr: 0x10, Data: []byte{0x42}})
+	}()
+
+	// the message is retransmitted until acknowledged
+	for i := 0; i < 2; i++ {
+		if pkt := b.Next(t); !bytes.Equal(pkt.Data, []byte{msgData, 0, 0x42}) {
+			t.Fatalf("Invalid message sent: %x", pkt.Data)
+		}
+	}
+
+	b.Receive(0x10, msgAck, 0)
+	if err := <-res; err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+
+	// until the attempts are used up
+	if err := r.SendSync(context.Background(), zbus.Packet{Addr: 0x10, Data: []byte{0x42}}); err != ErrTimeout {
+		t.Errorf("ErrTimeout expected, got %v", err)
+	}
+
+	if pkt := b.Next(t); pkt.Data[1] != 1 {
+		t.Errorf("Invalid sequence number: %x", pkt.Data)
+	}
+	b.Next(t)
+
+	r.Send(zbus.Packet{Addr: 0x10, Data: []byte{0x42}})
+	ev := bustest.NextEvent(t, r)
+	if ev.Type != zbus.ErrorEvent || ev.Err != zbus.AckError || !errors.Is(ev.Cause, ErrTimeout) {
+		t.Errorf("Ack error expected, got %+v", ev)
+	}
+}
+
+// TestFailure tests that messages fail without retransmission if they cannot be delivered.
+func TestFailure(t *testing.T) {
+	b := bustest.New()
+	r := New(b, WithRetry(zbus.RetryPolicy{Attempts: 5, Backoff: time.Second}))
+	defer r.Close()
+
+	big := zbus.Packet{Addr: 0x10, Data: make([]byte, MaxMessageSize+1)}
+	if err := r.SendSync(context.Background(), big); err != ErrTooLarge {
+		t.Errorf("ErrTooLarge expected, got %v", err)
+	}
+
+	if sent := b.Take(); len(sent) != 0 {
+		t.Errorf("Too large message sent: %+v", sent)
+	}
+
+	fail := errors.New("failure")
+	b.Fail(fail)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if err := r.SendSync(ctx, zbus.Packet{Addr: 0x10, Data: []byte{0x42}}); err != fail {
+		t.Errorf("Failure expected, got %v", err)
+	}
+
+	r.Send(big)
+	ev := bustest.NextEvent(t, r)
+	if ev.Type != zbus.ErrorEvent || ev.Err != zbus.AckError || !errors.Is(ev.Cause, ErrTooLarge) {
+		t.Errorf("Ack error expected, got %+v", ev)
+	}
+}
+
+// TestDuplicates tests that incoming messages are acknowledged and delivered once.
+func TestDuplicates(t *testing.T) {
+	b := bustest.New()
+	r := New(b)
+	defer r.Close()
+
+	for i := 0; i < 2; i++ {
+		b.Receive(0x10, msgData, 7, 0x42)
+
+		if pkt := b.Next(t); pkt.Addr != 0x10 || !bytes.Equal(pkt.Data, []byte{msgAck, 7}) {
+			t.Fatalf("Invalid acknowledgement: %+v", pkt)
+		}
+	}
+
+	if ev := bustest.NextEvent(t, r); ev.Type != zbus.PacketEvent || !bytes.Equal(ev.Pkt.Data, []byte{0x42}) {
+		t.Fatalf("Invalid packet event %+v", ev)
+	}
+
+	// a reconnected peer starts anew
+	b.Emit(zbus.Event{Type: zbus.ReregisterEvent, Addr: 0x10})
+	bustest.NextEvent(t, r)
+
+	b.Receive(0x10, msgData, 7, 0x43)
+	b.Next(t)
+
+	if ev := bustest.NextEvent(t, r); ev.Type != zbus.PacketEvent || !bytes.Equal(ev.Pkt.Data, []byte{0x43}) {
+		t.Fatalf("Invalid packet event %+v", ev)
+	}
+}
+
+// TestOrder tests that acknowledgements are sent in the order of the received messages.
+func TestOrder(t *testing.T) {
+	b := bustest.New()
+	r := New(b, WithEvents(zbus.WithEventCapacity(20)))
+	defer r.Close()
+
+	for seq := byte(0); seq < 20; seq++ {
+		b.Receive(0x10, msgData, seq, 0x42)
+	}
+
+	for seq := byte(0); seq < 20; seq++ {
+		if pkt := b.Next(t); !bytes.Equal(pkt.Data, []byte{msgAck, seq}) {
+			t.Fatalf("Invalid acknowledgement %x, sequence number %v expected", pkt.Data, seq)
+		}
+	}
+}
+
+// TestClose tests that closing the bus abandons the packets being sent to the underlying bus.
+func TestClose(t *testing.T) {
+	b := bustest.New()
+	r := New(b)
+
+	b.Stall()
+	r.Send(zbus.Packet{Addr: 0x10, Data: []byte{0x42}})
+	b.Next(t)
+
+	r.Close()
+	if pkt := b.Abandoned(t); !bytes.Equal(pkt.Data, []byte{msgData, 0, 0x42}) {
+		t.Errorf("Invalid abandoned packet %x", pkt.Data)
+	}
+}
+
+// TestShutdown tests that a graceful shutdown waits until the queued messages are acknowledged.
+func TestShutdown(t *testing.T) {
+	b := bustest.New()
+	r := New(b, WithRetry(zbus.RetryPolicy{Attempts: 5, Backoff: time.Second}))
+
+	r.Send(zbus.Packet{Addr: 0x10, Data: []byte{0x42}})
+	b.Next(t)
+
+	res := make(chan error)
+	go func() {
+		res <- r.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-res:
+		t.Fatalf("Shutdown did not wait for the acknowledgement: %v", err)
+	case <-time.After(20 * time.Millisecond):
+		break
+	}
+
+	if err := r.SendSync(context.Background(), zbus.Packet{Addr: 0x10}); err != zbus.ErrClosed {
+		t.Errorf("ErrClosed expected, got %v", err)
+	}
+
+	b.Receive(0x10, msgAck, 0)
+	if err := <-res; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	if _, ok := <-r.Events(); ok {
+		t.Errorf("Events channel not closed")
+	}
+}
+
+// TestBlockedLoop tests that messages are queued without blocking the sender while the event loop waits for the
+// consumer of the Events channel.
+func TestBlockedLoop(t *testing.T) {
+	b := bustest.New()
+	r := New(b)
+	defer r.Close()
+
+	// the last event blocks the loop
+	for i := 0; i <= zbus.EventCapacity; i++ {
+		b.Emit(zbus.Event{Type: zbus.ConnectEvent, Addr: 0x10})
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		r.Send(zbus.Packet{Addr: 0x10, Data: []byte{0x42}})
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		break
+	case <-time.After(time.Second):
+		t.Fatalf("Send blocked")
+	}
+
+	for i := 0; i <= zbus.EventCapacity; i++ {
+		bustest.NextEvent(t, r)
+	}
+
+	if pkt := b.Next(t); !bytes.Equal(pkt.Data, []byte{msgData, 0, 0x42}) {
+		t.Fatalf("Invalid message sent: %x", pkt.Data)
+	}
+}
+
+// TestSimBus tests reliable delivery over a simulated bus.
+func TestSimBus(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	sim, err := zbus.NewSimBus(addr, zbus.WithLogger(zbus.NewLogger(log.New(ioutil.Discard, "", 0), zbus.ErrorLevel)))
+	if err != nil {
+		t.Fatalf("Failed to create bus: %v", err)
+	}
+
+	r := New(sim)
+	defer r.Close()
+	bustest.NextEvent(t, r)
+
+	s, err := simslave.Dial(addr, zbus.Udid{0x01})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer s.Close()
+	bustest.NextEvent(t, r)
+
+	// the slave acknowledges the message
+	go func() {
+		if data, err := s.Recv(); err == nil {
+			_ = s.Send([]byte{msgAck, data[1]})
+		}
+	}()
+
+	if err := r.SendSync(context.Background(), zbus.Packet{Addr: s.Addr(), Data: []byte{0x42}}); err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+
+	// and gets its message acknowledged
+	if err := s.Send([]byte{msgData, 0, 0x43}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if ev := bustest.NextEvent(t, r); ev.Type != zbus.PacketEvent || !bytes.Equal(ev.Pkt.Data, []byte{0x43}) {
+		t.Fatalf("Invalid packet event %+v", ev)
+	}
+
+	if data, err := s.Recv(); err != nil || !bytes.Equal(data, []byte{msgAck, 0}) {
+		t.Fatalf("Invalid acknowledgement: %x, %v", data, err)
+	}
+}
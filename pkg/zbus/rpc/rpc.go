@@ -0,0 +1,440 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package rpc implements request/response calls on top of a zbus.Bus.
+
+Every packet starts with a two byte header: the message kind and the request ID. A request is answered by a response
+or an error response with the same ID, the data of an error response is the error message. Notifications are one-way
+messages that are sent by Send and reported by PacketEvents, their ID is ignored. Both the master and slaves can issue
+requests, requests of slaves are served by the handler of the bus. Slaves must use the same format.
+*/
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/wrap"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize = 2 // size of the message header
+
+	kindNotify   uint8 = 0x00 // one-way message
+	kindRequest  uint8 = 0x01 // request
+	kindResponse uint8 = 0x02 // successful response
+	kindError    uint8 = 0x03 // error response
+
+	// MaxMessageSize is the maximum size of a message sent over a bus with packets limited to zbus.MaxPacketSize.
+	MaxMessageSize = zbus.MaxPacketSize - headerSize
+
+	// DefaultTimeout is the default timeout of calls whose context has no deadline.
+	DefaultTimeout = time.Second
+
+	// DefaultConcurrency is the default maximum number of requests served concurrently.
+	DefaultConcurrency = 8
+)
+
+var (
+	// ErrBusy is returned by Call when too many calls to the same address are in progress. It is also the message of
+	// error responses to requests received while too many requests are being served.
+	ErrBusy = errors.New("too many pending calls")
+
+	// ErrNoHandler is the message of error responses to requests received while no handler is set.
+	ErrNoHandler = errors.New("no handler")
+
+	// ErrTooLarge is returned by Call when the request is larger than MaxMessageSize. It is also the message of error
+	// responses sent instead of responses larger than MaxMessageSize.
+	ErrTooLarge = errors.New("message too large")
+)
+
+// Handler serves a request received from the slave with the given address. The returned data is sent back in the
+// response, the message of a returned error (truncated to MaxMessageSize bytes) is sent back in an error response.
+type Handler func(ctx context.Context, addr zbus.Address, req []byte) ([]byte, error)
+
+// RemoteError is returned by Call when the peer answers with an error response.
+type RemoteError struct {
+	Addr zbus.Address
+	Msg  string
+}
+
+// Bus is a zbus.Bus that supports request/response calls. Incoming notifications are reported by PacketEvents, all
+// other events of the underlying bus are passed through. Pending calls fail when the bus is reset or closed.
+type Bus struct {
+	base
+	bus     zbus.Bus
+	loop    *wrap.Loop
+	timeout time.Duration
+	slots   chan struct{} // limits the number of requests being served
+	rejects chan struct{} // limits the number of ErrBusy responses being sent
+	events  []zbus.Option // options of the event dispatcher
+
+	mu      sync.Mutex
+	handler Handler
+	calls   map[zbus.Address]map[uint8]chan result // pending calls
+	next    map[zbus.Address]uint8                 // next request IDs
+	closed  bool
+}
+
+// base passes the methods of zbus.Bus that take no part in calls through to the underlying bus
+type base = wrap.Base
+
+// Option configures a Bus.
+type Option func(*Bus)
+
+type result struct {
+	resp []byte
+	err  error
+}
+
+// WithTimeout sets the timeout of calls whose context has no deadline. The default timeout is DefaultTimeout,
+// non-positive timeouts are ignored.
+func WithTimeout(d time.Duration) Option {
+	return func(r *Bus) {
+		if d > 0 {
+			r.timeout = d
+		}
+	}
+}
+
+// WithConcurrency sets the maximum number of requests served concurrently. Requests received while so many handlers
+// are running are answered by ErrBusy error responses. The default limit is DefaultConcurrency, non-positive limits are
+// ignored.
+func WithConcurrency(n int) Option {
+	return func(r *Bus) {
+		if n > 0 {
+			r.slots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithEvents configures the Events channel and subscriptions of the bus by the zbus.WithEventCapacity,
+// zbus.WithOverflow and zbus.WithLogger options, other options are ignored. The defaults are those of zbus, not the
+// configuration of the underlying bus, so the options it was created with are usually passed here as well.
+func WithEvents(opts ...zbus.Option) Option {
+	return func(r *Bus) {
+		r.events = append(r.events, opts...)
+	}
+}
+
+// New creates an RPC bus on top of the given bus. The returned bus takes over the events of the underlying one, which
+// must not be used directly anymore.
+func New(b zbus.Bus, opts ...Option) *Bus {
+	r := &Bus{
+		bus:     b,
+		timeout: DefaultTimeout,
+		slots:   make(chan struct{}, DefaultConcurrency),
+		calls:   make(map[zbus.Address]map[uint8]chan result),
+		next:    make(map[zbus.Address]uint8),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.base, r.loop = wrap.New(b, r.events...)
+
+	r.rejects = make(chan struct{}, cap(r.slots))
+
+	go r.processEvents()
+
+	return r
+}
+
+// Handle sets the handler of requests received from slaves. Handlers are called concurrently, up to the limit set by
+// WithConcurrency.
+func (r *Bus) Handle(h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handler = h
+}
+
+// Call sends the request to the slave with the given address and waits for its response. It returns a *RemoteError
+// if the slave answers with an error response, ErrTooLarge if the request is larger than MaxMessageSize,
+// zbus.ErrNoSlave if the slave disconnects and the error of the context if it is done before the response arrives.
+func (r *Bus) Call(ctx context.Context, addr zbus.Address, req []byte) ([]byte, error) {
+	if len(req) > MaxMessageSize {
+		return nil, ErrTooLarge
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	id, res, err := r.register(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unregister(addr, id)
+
+	if err := r.bus.SendSync(ctx, packet(addr, kindRequest, id, req)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-res:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Send sends a notification. Failures are reported by error events.
+func (r *Bus) Send(pkt zbus.Packet) {
+	r.bus.Send(packet(pkt.Addr, kindNotify, 0, pkt.Data))
+}
+
+// SendSync sends a notification and waits until it is delivered.
+func (r *Bus) SendSync(ctx context.Context, pkt zbus.Packet) error {
+	return r.bus.SendSync(ctx, packet(pkt.Addr, kindNotify, 0, pkt.Data))
+}
+
+// Error returns the error message.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error (address %02X): %v", e.Addr, e.Msg)
+}
+
+// allocates a request ID for a call
+func (r *Bus) register(addr zbus.Address) (uint8, chan result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return 0, nil, zbus.ErrClosed
+	}
+
+	calls := r.calls[addr]
+	if calls == nil {
+		calls = make(map[uint8]chan result)
+		r.calls[addr] = calls
+	}
+
+	if len(calls) > 0xFF {
+		return 0, nil, ErrBusy
+	}
+
+	// find an unused ID
+	id := r.next[addr]
+	for calls[id] != nil {
+		id++
+	}
+	r.next[addr] = id + 1
+
+	res := make(chan result, 1)
+	calls[id] = res
+
+	return id, res, nil
+}
+
+func (r *Bus) unregister(addr zbus.Address, id uint8) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.calls[addr], id)
+}
+
+// completes the pending call
+func (r *Bus) complete(addr zbus.Address, id uint8, res result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ch := r.calls[addr][id]; ch != nil {
+		delete(r.calls[addr], id)
+		ch <- res
+	}
+}
+
+// fails all pending calls to the address
+func (r *Bus) fail(addr zbus.Address, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, ch := range r.calls[addr] {
+		delete(r.calls[addr], id)
+		ch <- result{err: err}
+	}
+}
+
+// fails all pending calls
+func (r *Bus) failAll(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, calls := range r.calls {
+		for id, ch := range calls {
+			delete(calls, id)
+			ch <- result{err: err}
+		}
+	}
+}
+
+func (r *Bus) processEvents() {
+	defer func() {
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+
+		r.failAll(zbus.ErrClosed)
+
+		r.loop.Close()
+	}()
+
+	for {
+		select {
+		case ev, ok := <-r.bus.Events():
+			if !ok {
+				return
+			}
+
+			r.process(ev)
+
+		case <-r.loop.Posted():
+			r.loop.Run()
+		}
+	}
+}
+
+func (r *Bus) process(ev zbus.Event) {
+	switch ev.Type {
+	case zbus.PacketEvent:
+		r.receive(ev.Pkt)
+		return
+
+	case zbus.ResetEvent:
+		r.failAll(zbus.ErrNoSlave)
+
+	case zbus.DisconnectEvent, zbus.ReregisterEvent:
+		r.fail(ev.Addr, zbus.ErrNoSlave)
+	}
+
+	r.loop.Emit(ev)
+}
+
+func (r *Bus) receive(pkt *zbus.Packet) {
+	if len(pkt.Data) < headerSize {
+		r.loop.Emit((&zbus.Error{Type: zbus.BusError, Addr: pkt.Addr, Err: errors.New("invalid message header")}).Event())
+		return
+	}
+
+	kind, id, data := pkt.Data[0], pkt.Data[1], pkt.Data[headerSize:]
+
+	switch kind {
+	case kindNotify:
+		r.loop.Emit(zbus.Event{Type: zbus.PacketEvent, Pkt: &zbus.Packet{Addr: pkt.Addr, Data: data}})
+
+	case kindRequest:
+		select {
+		case r.slots <- struct{}{}:
+			go r.serve(pkt.Addr, id, data)
+		default:
+			r.reject(pkt.Addr, id)
+		}
+
+	case kindResponse:
+		r.complete(pkt.Addr, id, result{resp: data})
+
+	case kindError:
+		r.complete(pkt.Addr, id, result{err: &RemoteError{Addr: pkt.Addr, Msg: string(data)}})
+
+	default:
+		r.loop.Emit((&zbus.Error{Type: zbus.BusError, Addr: pkt.Addr, Err: errors.New("invalid message kind")}).Event())
+	}
+}
+
+// serves the request and sends back the response
+func (r *Bus) serve(addr zbus.Address, id uint8, req []byte) {
+	defer func() {
+		<-r.slots
+	}()
+
+	r.mu.Lock()
+	h := r.handler
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	var resp []byte
+	err := ErrNoHandler
+	if h != nil {
+		resp, err = h(ctx, addr, req)
+	}
+
+	if err == nil && len(resp) > MaxMessageSize {
+		err = ErrTooLarge
+	}
+
+	pkt := packet(addr, kindResponse, id, resp)
+	if err != nil {
+		pkt = packet(addr, kindError, id, errorMessage(err))
+	}
+
+	r.respond(ctx, pkt)
+}
+
+// answers the request by an ErrBusy error response, the request is dropped and reported if even the error responses
+// pile up
+func (r *Bus) reject(addr zbus.Address, id uint8) {
+	select {
+	case r.rejects <- struct{}{}:
+		break
+	default:
+		r.loop.Emit((&zbus.Error{Type: zbus.BusError, Addr: addr, Err: ErrBusy}).Event())
+		return
+	}
+
+	go func() {
+		defer func() {
+			<-r.rejects
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+
+		r.respond(ctx, packet(addr, kindError, id, errorMessage(ErrBusy)))
+	}()
+}
+
+// sends the response, a failure is reported by an AckError event
+func (r *Bus) respond(ctx context.Context, pkt zbus.Packet) {
+	if err := r.bus.SendSync(ctx, pkt); err != nil && err != zbus.ErrClosed {
+		r.loop.Report((&zbus.Error{Type: zbus.AckError, Addr: pkt.Addr, Err: err}).Event())
+	}
+}
+
+// returns the message of the error that fits into an error response
+func errorMessage(err error) []byte {
+	msg := err.Error()
+	if len(msg) > MaxMessageSize {
+		msg = strings.ToValidUTF8(msg[:MaxMessageSize], "")
+	}
+
+	return []byte(msg)
+}
+
+func packet(addr zbus.Address, kind, id uint8, data []byte) zbus.Packet {
+	buf := make([]byte, headerSize, headerSize+len(data))
+	buf[0] = kind
+	buf[1] = id
+
+	return zbus.Packet{Addr: addr, Data: append(buf, data...)}
+}
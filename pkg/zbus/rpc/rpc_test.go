@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/bustest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCall tests calls of slaves.
+func TestCall(t *testing.T) {
+	b := bustest.New()
+	r := New(b, WithTimeout(20*time.Millisecond))
+	defer r.Close()
+
+	type call struct {
+		resp []byte
+		err  error
+	}
+
+	calls := make(chan call)
+	do := func() {
+		go func() {
+			resp, err := r.Call(context.Background(), 0x10, []byte{0x42})
+			calls <- call{resp, err}
+		}()
+	}
+
+	// response
+	do()
+	req := b.Next(t)
+	if req.Addr != 0x10 || !bytes.Equal(req.Data[2:], []byte{0x42}) || req.Data[0] != kindRequest {
+		t.Fatalf("Invalid request %+v", req)
+	}
+
+	b.Receive(0x10, kindResponse, req.Data[1], 0x43)
+	if c := <-calls; c.err != nil || !bytes.Equal(c.resp, []byte{0x43}) {
+		t.Fatalf("Invalid response: %x, %v", c.resp, c.err)
+	}
+
+	// error response
+	do()
+	req = b.Next(t)
+	b.Receive(0x10, kindError, req.Data[1], 'x')
+
+	var re *RemoteError
+	if c := <-calls; !errors.As(c.err, &re) || re.Msg != "x" {
+		t.Fatalf("Remote error expected, got %v", c.err)
+	}
+
+	// no response
+	do()
+	b.Next(t)
+	if c := <-calls; c.err != context.DeadlineExceeded {
+		t.Fatalf("Timeout expected, got %v", c.err)
+	}
+
+	// disconnected slave
+	do()
+	b.Next(t)
+	b.Emit(zbus.Event{Type: zbus.DisconnectEvent, Addr: 0x10})
+	if c := <-calls; c.err != zbus.ErrNoSlave {
+		t.Fatalf("ErrNoSlave expected, got %v", c.err)
+	}
+}
+
+// TestHandle tests serving of requests and notifications received from slaves.
+func TestHandle(t *testing.T) {
+	b := bustest.New()
+	r := New(b)
+	defer r.Close()
+
+	b.Receive(0x10, kindRequest, 7, 0x42)
+	if pkt := b.Next(t); !bytes.Equal(pkt.Data, append([]byte{kindError, 7}, ErrNoHandler.Error()...)) {
+		t.Fatalf("Invalid error response %x", pkt.Data)
+	}
+
+	r.Handle(func(ctx context.Context, addr zbus.Address, req []byte) ([]byte, error) {
+		return append(req, byte(addr)), nil
+	})
+
+	b.Receive(0x10, kindRequest, 8, 0x42)
+	if pkt := b.Next(t); pkt.Addr != 0x10 || !bytes.Equal(pkt.Data, []byte{kindResponse, 8, 0x42, 0x10}) {
+		t.Fatalf("Invalid response %+v", pkt)
+	}
+
+	b.Receive(0x10, kindNotify, 0, 0x42)
+	if ev := <-r.Events(); ev.Type != zbus.PacketEvent || !bytes.Equal(ev.Pkt.Data, []byte{0x42}) {
+		t.Fatalf("Invalid packet event %+v", ev)
+	}
+
+	r.Send(zbus.Packet{Addr: 0x10, Data: []byte{0x42}})
+	if pkt := b.Next(t); !bytes.Equal(pkt.Data, []byte{kindNotify, 0, 0x42}) {
+		t.Fatalf("Invalid notification %x", pkt.Data)
+	}
+}
+
+// TestHandleLimits tests that requests and responses are limited.
+func TestHandleLimits(t *testing.T) {
+	b := bustest.New()
+	r := New(b, WithConcurrency(1))
+	defer r.Close()
+
+	release := make(chan struct{})
+	r.Handle(func(ctx context.Context, addr zbus.Address, req []byte) ([]byte, error) {
+		switch req[0] {
+		case 0:
+			<-release
+			return nil, nil
+		case 1:
+			return make([]byte, MaxMessageSize+1), nil
+		default:
+			return nil, errors.New(strings.Repeat("x", MaxMessageSize+1))
+		}
+	})
+
+	// the handler is busy
+	b.Receive(0x10, kindRequest, 1, 0)
+	b.Receive(0x10, kindRequest, 2, 0)
+	if pkt := b.Next(t); !bytes.Equal(pkt.Data, append([]byte{kindError, 2}, ErrBusy.Error()...)) {
+		t.Fatalf("Busy error response expected, got %x", pkt.Data)
+	}
+
+	close(release)
+	if pkt := b.Next(t); !bytes.Equal(pkt.Data, []byte{kindResponse, 1}) {
+		t.Fatalf("Invalid response %x", pkt.Data)
+	}
+
+	// the response is too large
+	b.Receive(0x10, kindRequest, 3, 1)
+	if pkt := b.Next(t); !bytes.Equal(pkt.Data, append([]byte{kindError, 3}, ErrTooLarge.Error()...)) {
+		t.Fatalf("Too large error response expected, got %x", pkt.Data)
+	}
+
+	// the error message is truncated
+	b.Receive(0x10, kindRequest, 4, 2)
+	if pkt := b.Next(t); len(pkt.Data) != zbus.MaxPacketSize || pkt.Data[0] != kindError {
+		t.Fatalf("Truncated error response expected, got %x", pkt.Data)
+	}
+
+	if _, err := r.Call(context.Background(), 0x10, make([]byte, MaxMessageSize+1)); err != ErrTooLarge {
+		t.Errorf("ErrTooLarge expected, got %v", err)
+	}
+}
@@ -15,37 +15,39 @@
 package zbus
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/simproto"
 	"io"
-	"log"
 	"net"
+	"sync"
 )
 
-const (
-	magic   uint16 = 0x7082
-	version uint16 = 0x0000
-
-	cmdPacket uint8 = 0x00
-	cmdConf   uint8 = 0x01
-	cmdQuit   uint8 = 0xFF
-)
+var errProtocol = errors.New("protocol violation")
 
 // SimBus is a simulated Zbus implementation that creates a TCP server
 type SimBus struct {
-	ev   chan Event
+	ev   *Dispatcher
 	work chan func() error
 	conn chan client
 	disc chan client
+	stop chan struct{}
 	done chan struct{}
 	term chan struct{}
 
 	addr    string
 	server  *net.TCPListener
 	clients map[Address]client
+	slaves  sync.WaitGroup // client connections being processed
+
+	stopOnce sync.Once
+	doneOnce sync.Once
 
-	arp arp
+	arp   arp
+	cfg   config
+	stats *counters
 }
 
 type client struct {
@@ -55,17 +57,26 @@ type client struct {
 }
 
 // NewSimBus creates a new Zbus simulator listening on the provided address.
-func NewSimBus(addr string) (*SimBus, error) {
+func NewSimBus(addr string, opts ...Option) (*SimBus, error) {
+	cfg := newConfig(opts)
+	if err := cfg.setup(); err != nil {
+		return nil, err
+	}
+
 	b := &SimBus{
-		ev:   make(chan Event, EventCapacity),
+		ev:   newDispatcher(&cfg),
 		work: make(chan func() error),
 		conn: make(chan client),
 		disc: make(chan client),
+		stop: make(chan struct{}),
 		done: make(chan struct{}),
 		term: make(chan struct{}),
 
 		addr:    addr,
 		clients: make(map[Address]client),
+		arp:     newArp(&cfg),
+		cfg:     cfg,
+		stats:   newCounters(),
 	}
 
 	go b.processWork()
@@ -76,89 +87,172 @@ func NewSimBus(addr string) (*SimBus, error) {
 
 // Close closes the simulated bus.
 func (b *SimBus) Close() {
-	defer func() {
-		// handle the case when the done/term channels are already closed
-		_ = recover()
-	}()
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
 
-	log.Println("closing bus")
-	close(b.done)
+	b.cfg.log.Log(InfoLevel, "closing bus", "listen", b.addr)
+	b.quit()
+	b.ev.Abort()
 	<-b.term
 }
 
+// Shutdown closes the simulated bus gracefully. The clients are notified by the quit command and disconnected.
+func (b *SimBus) Shutdown(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+
+	err := invoke(ctx, b.work, b.term, func(done func(error)) error {
+		b.cfg.log.Log(InfoLevel, "shutting down bus", "listen", b.addr)
+
+		if err := drain(b.work); err != nil {
+			return err
+		}
+
+		b.closeAll()
+		b.quit()
+		done(nil)
+		return nil
+	})
+
+	if err := awaitShutdown(ctx, b.term, err); err != nil {
+		return err
+	}
+
+	// wait for the client connections to be closed
+	closed := make(chan struct{})
+	go func() {
+		b.slaves.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Reset resets the simulated bus by closing and re-opening the server
 func (b *SimBus) Reset() {
-	b.work <- func() error {
-		log.Println("resetting bus")
+	ok := submit(b.work, b.stop, b.term, func() error {
+		b.cfg.log.Log(InfoLevel, "resetting bus")
 
 		b.closeAll()
 
 		// reset ARP and re-open server
 		b.clients = make(map[Address]client)
-		b.arp = arp{}
+		b.arp.reset()
 
 		ln, err := net.Listen("tcp", b.addr)
 		if err != nil {
 			return err
 		}
 
-		b.ev <- Event{Type: ResetEvent}
+		b.emit(Event{Type: ResetEvent})
 		b.server = ln.(*net.TCPListener)
 
 		go b.processServer(b.server)
 
 		return nil
+	})
+
+	if !ok {
+		b.cfg.log.Log(WarnLevel, "bus closed, reset ignored")
 	}
 }
 
 // Send sends a packet via the simulated bus.
 func (b *SimBus) Send(pkt Packet) {
-	b.work <- func() error {
-		log.Printf("sending packet %v\n", pkt)
-
-		// find client connection
-		// TODO(mbenda): check ARP?
-		cl, ok := b.clients[pkt.Addr]
-		if !ok {
-			// client not found
-			b.ev <- Event{Type: ErrorEvent, Err: AckError, Addr: pkt.Addr}
-			return nil
+	ok := submit(b.work, b.stop, b.term, func() error {
+		if ack := b.send(pkt); ack != nil {
+			b.emit(errorEvent(AckError, pkt.Addr, ack))
 		}
 
-		// and send the packet
-		data := []byte{cmdPacket, pkt.Len()}
-		data = append(data, pkt.Data...)
+		return nil
+	})
 
-		_, err := cl.conn.Write(data)
-		if err != nil {
-			b.ev <- Event{Type: ErrorEvent, Err: AckError, Addr: pkt.Addr}
-			return nil
-		}
+	if !ok {
+		b.cfg.log.Log(WarnLevel, "bus closed, packet dropped", "addr", addrString(pkt.Addr), "len", len(pkt.Data))
+	}
+}
 
-		return nil
+// SendSync sends a packet via the simulated bus and waits until it is written to the client connection.
+func (b *SimBus) SendSync(ctx context.Context, pkt Packet) error {
+	if stopped(b.stop) {
+		return ErrClosed
 	}
+
+	return invoke(ctx, b.work, b.term, func(done func(error)) error {
+		done(b.send(pkt))
+		return nil
+	})
 }
 
 // Events provides access to the channel of bus events.
 func (b *SimBus) Events() <-chan Event {
-	return b.ev
+	return b.ev.Events()
+}
+
+// DroppedEvents returns the number of events dropped according to the overflow policy.
+func (b *SimBus) DroppedEvents() uint64 {
+	return b.ev.Dropped()
+}
+
+// Stats returns the statistics of the bus.
+func (b *SimBus) Stats() Stats {
+	return b.stats.stats(b.ev)
+}
+
+// Devices returns information about all connected clients.
+func (b *SimBus) Devices() []DeviceInfo {
+	return devices(b.term, &b.arp)
+}
+
+// Device returns information about the client with the given address.
+func (b *SimBus) Device(addr Address) (DeviceInfo, bool) {
+	return device(b.term, &b.arp, addr)
+}
+
+// Subscribe returns a channel of the selected bus events.
+func (b *SimBus) Subscribe(filters ...Filter) (<-chan Event, func()) {
+	return b.ev.Subscribe(filters...)
+}
+
+// Terminates the work loop.
+func (b *SimBus) quit() {
+	b.doneOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+func (b *SimBus) emit(ev Event) {
+	b.stats.count(ev, &b.arp)
+	logEvent(b.cfg.log, ev)
+	b.ev.Emit(ev)
 }
 
 func (b *SimBus) closeAll() {
 	// close the listener and all client connections
 	if b.server != nil {
 		_ = b.server.Close()
+		b.server = nil
 	}
 
-	for _, cl := range b.clients {
+	for addr, cl := range b.clients {
 		closeClient(cl)
+		delete(b.clients, addr)
 	}
 }
 
 func (b *SimBus) processWork() {
 	defer func() {
-		log.Println("terminating")
+		b.cfg.log.Log(DebugLevel, "terminating")
 		b.closeAll()
+		b.ev.Close()
 		close(b.term)
 	}()
 
@@ -170,29 +264,43 @@ func (b *SimBus) processWork() {
 
 		case fn := <-b.work:
 			if err := fn(); err != nil {
-				log.Println(err)
-				b.ev <- Event{Type: ErrorEvent, Err: SysError} // TODO(mbenda): error reporting
+				b.emit(errorEvent(SysError, 0, err))
 				return
 			}
 
 		case c := <-b.conn:
 			// new incoming connection
-			log.Printf("registering new client %v\n", *c.dev)
+			b.cfg.log.Log(InfoLevel, "registering new client",
+				"udid", udidString(c.dev.Id), "remote", c.conn.RemoteAddr())
+
+			slave, old, err := b.arp.register(c.dev)
+			if old != nil && old != slave {
+				// the client lost its previous address
+				if prev, ok := b.clients[old.addr]; ok {
+					b.cfg.log.Log(InfoLevel, "closing previous client connection",
+						"addr", addrString(old.addr), "remote", prev.conn.RemoteAddr())
+
+					closeClient(prev)
+					delete(b.clients, old.addr)
+				}
+
+				b.emit(Event{Type: DisconnectEvent, Addr: old.addr})
+			}
 
-			slave, err := b.arp.register(c.dev)
 			if err != nil {
 				// reject the client
-				log.Println("rejecting client:", err)
+				b.cfg.log.Log(WarnLevel, "rejecting client", "udid", udidString(c.dev.Id), "err", err)
 
 				_ = c.conn.Close()
-				b.ev <- Event{Type: ErrorEvent, Err: RegError}
+				b.emit(errorEvent(RegError, 0, err))
 				continue
 			}
 
 			prev, ok := b.clients[slave.addr]
 			if ok {
 				// drop previous client
-				log.Printf("closing previous client connection from %v\n", c.conn.RemoteAddr())
+				b.cfg.log.Log(InfoLevel, "closing previous client connection",
+					"addr", addrString(slave.addr), "remote", prev.conn.RemoteAddr())
 
 				closeClient(prev)
 			}
@@ -200,8 +308,18 @@ func (b *SimBus) processWork() {
 			c.addr = slave.addr
 			b.clients[slave.addr] = c
 
-			b.ev <- Event{Type: ConnectEvent, Addr: c.addr}
+			if err := b.cfg.leases.update(c.dev.Id, c.addr); err != nil {
+				b.cfg.log.Log(WarnLevel, "failed to store lease",
+					"addr", addrString(c.addr), "udid", udidString(c.dev.Id), "err", err)
+			}
+
+			if old == slave {
+				b.emit(Event{Type: ReregisterEvent, Addr: c.addr, Dev: c.dev})
+			} else {
+				b.emit(Event{Type: ConnectEvent, Addr: c.addr, Dev: c.dev})
+			}
 
+			b.slaves.Add(1)
 			go b.processSlave(c)
 
 		case c := <-b.disc:
@@ -212,12 +330,44 @@ func (b *SimBus) processWork() {
 				delete(b.clients, c.addr)
 				b.arp.unregister(b.arp.slave(c.addr))
 
-				b.ev <- Event{Type: DisconnectEvent, Addr: c.addr}
+				b.emit(Event{Type: DisconnectEvent, Addr: c.addr})
 			}
 		}
 	}
 }
 
+func (b *SimBus) send(pkt Packet) error {
+	b.cfg.log.Log(DebugLevel, "sending packet", "addr", addrString(pkt.Addr), "len", len(pkt.Data))
+
+	// find client connection
+	// TODO(mbenda): check ARP?
+	cl, ok := b.clients[pkt.Addr]
+	if !ok {
+		// client not found
+		return ErrNoSlave
+	}
+
+	// and send the packet
+	data := []byte{simproto.CmdPacket, pkt.Len()}
+	data = append(data, pkt.Data...)
+	if b.cfg.crc {
+		data = append(data, pec(pkt.Addr, false, pkt.Data))
+	}
+
+	if _, err := cl.conn.Write(data); err != nil {
+		b.stats.update(func(s *Stats) { s.Nacks++ })
+		return ErrAck
+	}
+
+	if s := b.arp.slave(pkt.Addr); s != nil {
+		b.arp.touch(s)
+	}
+
+	b.stats.update(func(s *Stats) { s.Sent[pkt.Addr]++ })
+
+	return nil
+}
+
 func (b *SimBus) processServer(ln *net.TCPListener) {
 	for {
 		conn, err := ln.AcceptTCP()
@@ -230,28 +380,34 @@ func (b *SimBus) processServer(ln *net.TCPListener) {
 }
 
 func (b *SimBus) processHandshake(conn *net.TCPConn) {
-	log.Printf("new connection from %v", conn.RemoteAddr())
+	b.cfg.log.Log(DebugLevel, "new connection", "remote", conn.RemoteAddr())
 
 	// write server handshake
 	data := make([]byte, 4)
-	binary.BigEndian.PutUint16(data, magic)
-	binary.BigEndian.PutUint16(data[2:], version)
+	binary.BigEndian.PutUint16(data, simproto.Magic)
+	binary.BigEndian.PutUint16(data[2:], simproto.Version)
 	_, err := conn.Write(data)
 	if err != nil {
-		log.Println("client handshake error:", err)
+		b.cfg.log.Log(WarnLevel, "client handshake error", "remote", conn.RemoteAddr(), "err", err)
 		return
 	}
 
 	// read client handshake
 	udid, err := parseHandshake(conn)
 	if err != nil {
-		log.Println("client handshake error:", err)
+		b.cfg.log.Log(WarnLevel, "client handshake error", "remote", conn.RemoteAddr(), "err", err)
 		_ = conn.Close()
 		return
 	}
 
 	// let the main loop register the client
-	b.conn <- client{conn: conn, dev: &Device{Id: udid}}
+	select {
+	case b.conn <- client{conn: conn, dev: &Device{Id: udid}}:
+		break
+
+	case <-b.term:
+		_ = conn.Close()
+	}
 }
 
 func parseHandshake(conn *net.TCPConn) (Udid, error) {
@@ -262,13 +418,13 @@ func parseHandshake(conn *net.TCPConn) (Udid, error) {
 	}
 
 	// check header
-	if n != 4 || binary.BigEndian.Uint16(buf) != magic {
+	if n != 4 || binary.BigEndian.Uint16(buf) != simproto.Magic {
 		return Udid{}, errors.New("no magic")
 	}
 
 	ver := binary.BigEndian.Uint16(buf[2:])
-	if (ver & 0xFF00) != (version & 0xFF00) {
-		return Udid{}, fmt.Errorf("incompatible versions (client: %04x, server: %04x)", ver, version)
+	if (ver & 0xFF00) != (simproto.Version & 0xFF00) {
+		return Udid{}, fmt.Errorf("incompatible versions (client: %04x, server: %04x)", ver, simproto.Version)
 	}
 
 	// read UDID
@@ -287,17 +443,24 @@ func parseHandshake(conn *net.TCPConn) (Udid, error) {
 
 func (b *SimBus) processSlave(c client) {
 	defer func() {
-		b.disc <- c
+		select {
+		case b.disc <- c:
+			break
+
+		case <-b.term:
+			break
+		}
+
 		_ = c.conn.Close()
+		b.slaves.Done()
 	}()
 
-	log.Printf("processing connection from %v", c.conn.RemoteAddr())
+	b.cfg.log.Log(DebugLevel, "processing connection", "addr", addrString(c.addr), "remote", c.conn.RemoteAddr())
 
 	// let the client know its address
-	_, err := c.conn.Write([]byte{cmdConf, c.addr})
+	_, err := c.conn.Write([]byte{simproto.CmdConf, c.addr})
 	if err != nil {
-		log.Println("client I/O error:", err)
-		b.ev <- Event{Type: ErrorEvent, Err: BusError}
+		b.report(errorEvent(BusError, c.addr, err))
 		return
 	}
 
@@ -312,36 +475,71 @@ func (b *SimBus) processSlave(c client) {
 		}
 
 		if err != nil {
-			log.Println("client I/O error:", err)
-			b.ev <- Event{Type: ErrorEvent, Err: BusError}
+			b.report(errorEvent(BusError, c.addr, err))
 			return
 		}
 
-		if n != 2 || header[0] != cmdPacket {
-			log.Println("client I/O error: protocol violation")
-			b.ev <- Event{Type: ErrorEvent, Err: BusError}
+		if n != 2 || header[0] != simproto.CmdPacket {
+			b.report(errorEvent(BusError, c.addr, errProtocol))
 			return
 		}
 
-		// read packet data
-		pkt := Packet{Addr: c.addr, Data: make([]byte, int(header[1]))}
-		for i := 0; i < len(pkt.Data); {
-			n, err = c.conn.Read(pkt.Data[i:])
+		// read packet data (followed by the CRC if enabled)
+		n = int(header[1])
+		buf := make([]byte, n, n+1)
+		if b.cfg.crc {
+			buf = buf[:n+1]
+		}
+
+		for i := 0; i < len(buf); {
+			k, err := c.conn.Read(buf[i:])
 			if err != nil {
-				log.Println("client I/O error:", err)
-				b.ev <- Event{Type: ErrorEvent, Err: BusError}
+				b.report(errorEvent(BusError, c.addr, err))
 				return
 			}
 
-			i += n
+			i += k
+		}
+
+		if b.cfg.crc && pec(c.addr, true, buf[:n]) != buf[n] {
+			b.report(errorEvent(CrcError, c.addr, nil))
+			continue
 		}
 
-		b.ev <- Event{Type: PacketEvent, Pkt: &pkt}
+		// let the main loop update the last seen time of the client
+		pkt := &Packet{Addr: c.addr, Data: buf[:n]}
+		b.post(func() error {
+			if b.clients[c.addr] == c {
+				b.arp.touch(b.arp.slave(c.addr))
+			}
+
+			b.emit(Event{Type: PacketEvent, Pkt: pkt})
+			return nil
+		})
+	}
+}
+
+// Emits the event from outside of the work loop.
+func (b *SimBus) report(ev Event) {
+	b.post(func() error {
+		b.emit(ev)
+		return nil
+	})
+}
+
+// Submits the work unless the bus has been closed.
+func (b *SimBus) post(fn func() error) {
+	select {
+	case b.work <- fn:
+		break
+
+	case <-b.term:
+		break
 	}
 }
 
 func closeClient(c client) {
 	// deliberately ignore errors
-	_, _ = c.conn.Write([]byte{cmdQuit})
+	_, _ = c.conn.Write([]byte{simproto.CmdQuit})
 	_ = c.conn.CloseRead()
 }
@@ -0,0 +1,213 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package simslave implements the slave side of the zen-bus simulator protocol, i.e. the TCP protocol served by
+zbus.SimBus. It can be used to write virtual slave devices and integration tests without the module firmware.
+*/
+package simslave
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"github.com/omSquare/zen-bus/pkg/zbus/internal/simproto"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrQuit is returned by Recv when the master closed the connection, e.g. because the bus has been reset.
+	ErrQuit = errors.New("connection closed by the master")
+
+	// ErrRejected is returned by Dial when the master refused to register the slave.
+	ErrRejected = errors.New("registration rejected")
+
+	errProtocol = errors.New("protocol violation")
+)
+
+// Slave is a connection of a simulated slave device to the master.
+type Slave struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex // serializes writes
+
+	id   zbus.Udid
+	addr zbus.Address
+	crc  bool
+}
+
+// Option configures a Slave.
+type Option func(*Slave)
+
+// WithCRC enables CRC protection of packets, it must match the configuration of the bus (see zbus.WithCRC).
+func WithCRC() Option {
+	return func(s *Slave) {
+		s.crc = true
+	}
+}
+
+// Dial connects to the simulated bus at the given address in "host:port" format, performs the handshake and waits
+// until the master assigns the slave an address.
+func Dial(addr string, id zbus.Udid, opts ...Option) (*Slave, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Slave{conn: conn, r: bufio.NewReader(conn), id: id}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Id returns the UDID of the slave.
+func (s *Slave) Id() zbus.Udid {
+	return s.id
+}
+
+// Addr returns the address assigned to the slave.
+func (s *Slave) Addr() zbus.Address {
+	return s.addr
+}
+
+// Send sends a packet to the master. The packet must contain 1 to zbus.MaxPacketSize bytes.
+func (s *Slave) Send(data []byte) error {
+	if len(data) < 1 || len(data) > zbus.MaxPacketSize {
+		return fmt.Errorf("invalid packet length %v", len(data))
+	}
+
+	buf := make([]byte, 0, len(data)+3)
+	buf = append(buf, simproto.CmdPacket, uint8(len(data)))
+	buf = append(buf, data...)
+	if s.crc {
+		buf = append(buf, zbus.PEC(s.addr, true, data))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+// Recv waits for a packet from the master and returns its data. It returns ErrQuit when the master closes the
+// connection and an error matching zbus.ErrCrc when the packet is corrupted. Recv must not be called concurrently.
+func (s *Slave) Recv() ([]byte, error) {
+	cmd, err := s.r.ReadByte()
+	if err == io.EOF {
+		return nil, ErrQuit
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case simproto.CmdPacket:
+		break
+
+	case simproto.CmdQuit:
+		return nil, ErrQuit
+
+	default:
+		return nil, errProtocol
+	}
+
+	n, err := s.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, int(n), int(n)+1)
+	if s.crc {
+		buf = buf[:n+1]
+	}
+
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return nil, err
+	}
+
+	if s.crc {
+		if zbus.PEC(s.addr, false, buf[:n]) != buf[n] {
+			return nil, &zbus.Error{Type: zbus.CrcError, Addr: s.addr}
+		}
+		buf = buf[:n]
+	}
+
+	return buf, nil
+}
+
+// Close disconnects the slave from the bus.
+func (s *Slave) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Slave) handshake() error {
+	// read server handshake
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint16(hdr[:]) != simproto.Magic {
+		return errors.New("no magic")
+	}
+
+	ver := binary.BigEndian.Uint16(hdr[2:])
+	if (ver & 0xFF00) != (simproto.Version & 0xFF00) {
+		return fmt.Errorf("incompatible versions (client: %04x, server: %04x)", simproto.Version, ver)
+	}
+
+	// write client handshake
+	data := make([]byte, 4, 4+len(s.id))
+	binary.BigEndian.PutUint16(data, simproto.Magic)
+	binary.BigEndian.PutUint16(data[2:], simproto.Version)
+	data = append(data, s.id[:]...)
+
+	if _, err := s.conn.Write(data); err != nil {
+		return err
+	}
+
+	// wait for the address
+	var conf [2]byte
+	if _, err := io.ReadFull(s.r, conf[:1]); err == io.EOF {
+		return ErrRejected
+	} else if err != nil {
+		return err
+	}
+
+	if conf[0] == simproto.CmdQuit {
+		return ErrRejected
+	}
+
+	if conf[0] != simproto.CmdConf {
+		return errProtocol
+	}
+
+	if _, err := io.ReadFull(s.r, conf[1:]); err != nil {
+		return err
+	}
+
+	s.addr = conf[1]
+	return nil
+}
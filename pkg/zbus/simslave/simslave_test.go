@@ -0,0 +1,161 @@
+package simslave
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/omSquare/zen-bus/pkg/zbus"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func simBus(t *testing.T, opts ...zbus.Option) (*zbus.SimBus, string) {
+	t.Helper()
+
+	// find a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	opts = append(opts, zbus.WithLogger(zbus.NewLogger(log.New(ioutil.Discard, "", 0), zbus.ErrorLevel)))
+	b, err := zbus.NewSimBus(addr, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create bus: %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != zbus.ResetEvent {
+		t.Fatalf("Reset event expected, got %+v", ev)
+	}
+
+	return b, addr
+}
+
+func nextEvent(t *testing.T, b zbus.Bus) zbus.Event {
+	t.Helper()
+
+	select {
+	case ev := <-b.Events():
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("No event emitted")
+		return zbus.Event{}
+	}
+}
+
+// TestSlave tests the exchange of packets between a simulated bus and a slave.
+func TestSlave(t *testing.T) {
+	for _, crc := range []bool{false, true} {
+		var opts []zbus.Option
+		var slaveOpts []Option
+		if crc {
+			opts = append(opts, zbus.WithCRC())
+			slaveOpts = append(slaveOpts, WithCRC())
+		}
+
+		b, addr := simBus(t, opts...)
+
+		id := zbus.Udid{0x01, 0x02}
+		s, err := Dial(addr, id, slaveOpts...)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+
+		ev := nextEvent(t, b)
+		if ev.Type != zbus.ConnectEvent || ev.Addr != s.Addr() || ev.Dev.Id != id {
+			t.Fatalf("Invalid connect event %+v", ev)
+		}
+
+		// slave to master
+		data := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+		if err := s.Send(data); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+
+		ev = nextEvent(t, b)
+		if ev.Type != zbus.PacketEvent || ev.Pkt.Addr != s.Addr() || !bytes.Equal(ev.Pkt.Data, data) {
+			t.Fatalf("Invalid packet event %+v", ev)
+		}
+
+		// master to slave
+		if err := b.SendSync(context.Background(), zbus.Packet{Addr: s.Addr(), Data: data}); err != nil {
+			t.Fatalf("SendSync failed: %v", err)
+		}
+
+		if in, err := s.Recv(); err != nil || !bytes.Equal(in, data) {
+			t.Fatalf("Invalid packet received: %x, %v", in, err)
+		}
+
+		// closing the bus disconnects the slave
+		b.Close()
+
+		if _, err := s.Recv(); err != ErrQuit {
+			t.Errorf("ErrQuit expected, got %v", err)
+		}
+
+		_ = s.Close()
+	}
+}
+
+// TestRejected tests that a slave refused by the master fails to connect.
+func TestRejected(t *testing.T) {
+	b, addr := simBus(t, zbus.WithPolicy(zbus.Policy{Deny: [][]byte{{0x01}}}))
+	defer b.Close()
+
+	if _, err := Dial(addr, zbus.Udid{0x01}); err != ErrRejected {
+		t.Errorf("ErrRejected expected, got %v", err)
+	}
+
+	if ev := nextEvent(t, b); ev.Type != zbus.ErrorEvent || !errors.Is(ev.Cause, zbus.ErrDenied) {
+		t.Errorf("Registration error expected, got %+v", ev)
+	}
+}
+
+// TestShutdown tests that packets sent before a graceful shutdown are delivered before the slave is disconnected.
+func TestShutdown(t *testing.T) {
+	b, addr := simBus(t)
+
+	s, err := Dial(addr, zbus.Udid{0x01})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer s.Close()
+	nextEvent(t, b)
+
+	for i := 1; i <= 3; i++ {
+		b.Send(zbus.Packet{Addr: s.Addr(), Data: []byte{byte(i)}})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if in, err := s.Recv(); err != nil || !bytes.Equal(in, []byte{byte(i)}) {
+			t.Fatalf("Invalid packet received: %x, %v", in, err)
+		}
+	}
+
+	if _, err := s.Recv(); err != ErrQuit {
+		t.Errorf("ErrQuit expected, got %v", err)
+	}
+
+	if ev, ok := <-b.Events(); ok {
+		t.Errorf("Events channel not closed, got %+v", ev)
+	}
+
+	// the bus does not accept any work
+	b.Send(zbus.Packet{Addr: s.Addr(), Data: []byte{0x42}})
+	if err := b.SendSync(ctx, zbus.Packet{Addr: s.Addr(), Data: []byte{0x42}}); err != zbus.ErrClosed {
+		t.Errorf("ErrClosed expected, got %v", err)
+	}
+	b.Close()
+}
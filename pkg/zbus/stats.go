@@ -0,0 +1,126 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import "sync"
+
+// Stats holds counters and gauges describing the operation of a bus. Counters accumulate from the creation of the bus,
+// counters that do not apply to a bus implementation (e.g. Polls of SimBus) stay zero.
+type Stats struct {
+	// Sent holds the number of packets delivered to every slave address.
+	Sent map[Address]uint64
+
+	// Received holds the number of packets received from every slave address.
+	Received map[Address]uint64
+
+	// Nacks is the number of transactions with slaves that have not been acknowledged.
+	Nacks uint64
+
+	// CrcErrors is the number of corrupted packets and poll headers.
+	CrcErrors uint64
+
+	// Retries is the number of repeated transactions (see WithRetry).
+	Retries uint64
+
+	// Discoveries is the number of discovery cycles.
+	Discoveries uint64
+
+	// Polls is the number of poll transactions answered by slaves.
+	Polls uint64
+
+	// AlertLimits is the number of times the processing of the alert signal was interrupted by the limit of packets
+	// read in a row.
+	AlertLimits uint64
+
+	// DroppedEvents is the number of events dropped according to the overflow policy.
+	DroppedEvents uint64
+
+	// QueuedEvents is the number of events waiting for the consumer of the Events channel.
+	QueuedEvents int
+
+	// Slaves is the number of registered slaves.
+	Slaves int
+}
+
+// StatsProvider is a bus that keeps statistics. SimBus and I2CBus implement it, the buses layered on top of another
+// bus (see the frag, reliable and rpc packages) do not: the statistics of the underlying bus describe them.
+type StatsProvider interface {
+	// Stats returns the statistics of the bus. It does not wait for the bus, so it can be called even while the bus is
+	// busy or blocked by the consumer of its events.
+	Stats() Stats
+}
+
+// Holds the statistics of a bus. The counters are updated by the work loop and read by Stats without it, so that
+// the statistics are available even while the work loop is blocked.
+type counters struct {
+	mu sync.Mutex
+	s  Stats
+}
+
+func newCounters() *counters {
+	return &counters{s: Stats{Sent: make(map[Address]uint64), Received: make(map[Address]uint64)}}
+}
+
+// Updates the counters.
+func (c *counters) update(fn func(s *Stats)) {
+	c.mu.Lock()
+	fn(&c.s)
+	c.mu.Unlock()
+}
+
+// Updates the counters of the emitted event, together with the number of registered slaves.
+func (c *counters) count(ev Event, a *arp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.s.Slaves = a.num
+
+	switch {
+	case ev.Type == PacketEvent:
+		c.s.Received[ev.Pkt.Addr]++
+
+	case ev.Type == ErrorEvent && ev.Err == CrcError:
+		c.s.CrcErrors++
+	}
+}
+
+// Returns a copy of the statistics, including the gauges of the event dispatcher.
+func (c *counters) stats(d *Dispatcher) Stats {
+	c.mu.Lock()
+	res := c.s.clone()
+	c.mu.Unlock()
+
+	res.DroppedEvents = d.Dropped()
+	res.QueuedEvents = d.Queued()
+
+	return res
+}
+
+// Returns a copy of the statistics.
+func (s *Stats) clone() Stats {
+	c := *s
+	c.Sent = make(map[Address]uint64, len(s.Sent))
+	c.Received = make(map[Address]uint64, len(s.Received))
+
+	for addr, n := range s.Sent {
+		c.Sent[addr] = n
+	}
+
+	for addr, n := range s.Received {
+		c.Received[addr] = n
+	}
+
+	return c
+}
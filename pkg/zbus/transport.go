@@ -0,0 +1,326 @@
+// Copyright (c) 2019 omSquare s.r.o.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zbus
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// ErrZeroLength is returned by a Transport that cannot perform zero-length transactions, e.g. an I2C adapter with the
+// I2C_AQ_NO_ZERO_LEN quirk. Unlike other transfer errors, it is not fatal: the bus pings slaves by one-byte reads
+// instead.
+var ErrZeroLength = errors.New("zero-length transfers not supported")
+
+// Transport performs raw I2C transactions on behalf of I2CBus.
+type Transport interface {
+	// Transfer performs a single read or write transaction with the device at the given address. The returned flag
+	// reports whether the transaction was acknowledged. A non-nil error other than ErrZeroLength indicates an
+	// unrecoverable failure.
+	Transfer(addr Address, read bool, data []byte) (bool, error)
+
+	// Close releases all resources held by the transport.
+	Close() error
+}
+
+// AlertTransport is a Transport that provides the alert signal of the bus itself, like MemTransport does.
+type AlertTransport interface {
+	Transport
+
+	// Alert reports whether the alert signal is active, i.e. whether a slave has a packet to send.
+	Alert() bool
+}
+
+// MemTransport is an in-memory Transport that models a set of zen-bus slave devices. It is meant for testing the
+// bus logic without real hardware, it provides the alert signal as well (see NewI2CBusTransport).
+type MemTransport struct {
+	mu        sync.Mutex
+	slaves    []*MemSlave
+	cfg       config
+	noZeroLen bool // zero-length transactions are refused
+}
+
+// MemSlave is a scripted slave device attached to a MemTransport.
+type MemSlave struct {
+	t *MemTransport
+
+	id      Udid
+	addr    Address  // assigned address, zero if not configured
+	out     [][]byte // packets waiting for the master
+	in      [][]byte // packets received from the master
+	nack    int      // number of upcoming transactions that won't be acknowledged
+	corrupt int      // number of upcoming packets that will be corrupted
+	silent  bool     // the slave does not respond at all
+}
+
+// NewMemTransport creates an empty in-memory transport. The options must match the options of the bus, only WithCRC
+// is taken into account.
+func NewMemTransport(opts ...Option) *MemTransport {
+	return &MemTransport{cfg: newConfig(opts)}
+}
+
+// Attach connects a new unconfigured slave with the given UDID.
+func (t *MemTransport) Attach(id Udid) *MemSlave {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &MemSlave{t: t, id: id}
+	t.slaves = append(t.slaves, s)
+
+	return s
+}
+
+// Detach disconnects the slave from the transport.
+func (t *MemTransport) Detach(s *MemSlave) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, x := range t.slaves {
+		if x == s {
+			t.slaves = append(t.slaves[:i], t.slaves[i+1:]...)
+			return
+		}
+	}
+}
+
+// RefuseZeroLength makes the transport refuse zero-length transactions with ErrZeroLength, like I2C adapters with the
+// I2C_AQ_NO_ZERO_LEN quirk do.
+func (t *MemTransport) RefuseZeroLength() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.noZeroLen = true
+}
+
+// Alert reports the state of the alert signal, i.e. whether any configured slave has a packet to send.
+func (t *MemTransport) Alert() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.pending() != nil
+}
+
+// Transfer implements the Transport interface.
+func (t *MemTransport) Transfer(addr Address, read bool, data []byte) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(data) == 0 && t.noZeroLen {
+		return false, ErrZeroLength
+	}
+
+	switch addr {
+	case CallAddr:
+		// bus reset or quit, all slaves lose their configuration
+		ack := false
+		for _, s := range t.slaves {
+			if !s.silent {
+				s.addr = 0
+				s.out = nil
+				ack = true
+			}
+		}
+		return ack, nil
+
+	case ConfAddr:
+		if read {
+			// the unconfigured slave with the lowest UDID wins the arbitration
+			var s *MemSlave
+			for _, x := range t.slaves {
+				if !x.silent && x.addr == 0 && (s == nil || bytes.Compare(x.id[:], s.id[:]) < 0) {
+					s = x
+				}
+			}
+
+			if s == nil || len(data) < len(s.id) {
+				return false, nil
+			}
+
+			copy(data, s.id[:])
+			return true, nil
+		}
+
+		var id Udid
+		if len(data) != len(id)+1 {
+			return false, nil
+		}
+
+		copy(id[:], data)
+		for _, s := range t.slaves {
+			if !s.silent && s.addr == 0 && s.id == id {
+				if s.nacked() {
+					return false, nil
+				}
+
+				s.addr = data[len(id)]
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case PollAddr:
+		s := t.pending()
+		if !read || s == nil || len(data) < 2 {
+			return false, nil
+		}
+
+		data[0] = s.addr
+		data[1] = uint8(len(s.out[0]))
+		if t.cfg.crc && len(data) > 2 {
+			data[2] = pec(PollAddr, true, data[:2])
+		}
+		return true, nil
+	}
+
+	// addressed transaction
+	s := t.slave(addr)
+	if s == nil || s.nacked() {
+		return false, nil
+	}
+
+	if read {
+		if len(s.out) == 0 {
+			// nothing to send, the bus stays idle
+			for i := range data {
+				data[i] = 0xFF
+			}
+			return true, nil
+		}
+
+		n := copy(data, s.out[0])
+		s.out = s.out[1:]
+
+		if t.cfg.crc && n < len(data) {
+			data[n] = pec(addr, true, data[:n])
+		}
+
+		if s.corrupt > 0 {
+			s.corrupt--
+			data[0] ^= 0x01
+		}
+		return true, nil
+	}
+
+	if len(data) > 0 {
+		if t.cfg.crc {
+			// refuse corrupted packets
+			n := len(data) - 1
+			if n < 1 || pec(addr, false, data[:n]) != data[n] {
+				return false, nil
+			}
+			data = data[:n]
+		}
+
+		s.in = append(s.in, append([]byte(nil), data...))
+	}
+
+	return true, nil
+}
+
+// Close implements the Transport interface.
+func (t *MemTransport) Close() error {
+	return nil
+}
+
+// returns the configured slave with a pending packet and the lowest address
+func (t *MemTransport) pending() *MemSlave {
+	var s *MemSlave
+	for _, x := range t.slaves {
+		if !x.silent && x.addr != 0 && len(x.out) > 0 && (s == nil || x.addr < s.addr) {
+			s = x
+		}
+	}
+	return s
+}
+
+func (t *MemTransport) slave(addr Address) *MemSlave {
+	for _, s := range t.slaves {
+		if !s.silent && s.addr != 0 && s.addr == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// Id returns the UDID of the slave.
+func (s *MemSlave) Id() Udid {
+	return s.id
+}
+
+// Addr returns the address assigned to the slave or zero if the slave is not configured.
+func (s *MemSlave) Addr() Address {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	return s.addr
+}
+
+// Queue queues a packet to be sent to the master.
+func (s *MemSlave) Queue(data []byte) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.out = append(s.out, append([]byte(nil), data...))
+}
+
+// Received returns all packets received from the master so far.
+func (s *MemSlave) Received() [][]byte {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	return append([][]byte(nil), s.in...)
+}
+
+// Reset makes the slave lose its address and pending packets, as if it rebooted.
+func (s *MemSlave) Reset() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.addr = 0
+	s.out = nil
+}
+
+// Nack makes the slave refuse the next n transactions addressed to it.
+func (s *MemSlave) Nack(n int) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.nack = n
+}
+
+// Corrupt makes the slave corrupt the data of the next n packets sent to the master.
+func (s *MemSlave) Corrupt(n int) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.corrupt = n
+}
+
+// Silence makes the slave stop (or resume) responding to any transaction.
+func (s *MemSlave) Silence(silent bool) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.silent = silent
+}
+
+func (s *MemSlave) nacked() bool {
+	if s.nack > 0 {
+		s.nack--
+		return true
+	}
+	return false
+}